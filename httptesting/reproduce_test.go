@@ -4,8 +4,11 @@ import (
 	"bufio"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -16,6 +19,11 @@ var cmdDumpDb = "DUMP"
 var cmdSnapshot = "SNAPSHOT"
 var cmdEnd = "END"
 
+// `OOM_DRIVE=http` drives the testee through its http control server (like production does) instead of stdin
+const envDrive = "OOM_DRIVE"
+const envHttpAddr = "OOM_HTTP_ADDR" // same as the testee's
+const defaultHttpAddr = "localhost:8890"
+
 func TestReproduceOoM(t *testing.T) {
 	_ = os.Chdir("..")
 	testee, childStdout, childStdin := startMain(t)
@@ -23,8 +31,13 @@ func TestReproduceOoM(t *testing.T) {
 	defer childStdin.Close()
 	childOutReader := bufio.NewReader(childStdout)
 
-	waitForTestee(t, childOutReader)
+	waitForTestee(t, childOutReader, -1)
 	gatherProcStats(t)
+	if strings.EqualFold(os.Getenv(envDrive), "http") {
+		driveViaHttp(t, childOutReader)
+		_ = testee.Wait()
+		return
+	}
 	for r := 0; r < totalRuns; r++ {
 		_, _ = os.Stdout.WriteString(fmt.Sprintf("starting run: %d\n", r))
 		_ = os.Stdout.Sync()
@@ -32,11 +45,12 @@ func TestReproduceOoM(t *testing.T) {
 		_, _ = childStdin.Write([]byte(cmdDumpDb + "\n"))
 		//childStdin.Write([]byte(cmdSnapshot + "\n"));
 
-		waitForTestee(t, childOutReader)
+		waitForTestee(t, childOutReader, r)
 		time.Sleep(2 * time.Second) // allow garbage collection to happen
 		gatherProcStats(t)
 	}
 	printProcStats()
+	printProgressStats()
 	_, _ = childStdin.Write([]byte(cmdEnd + "\n"))
 
 	childStdout.Close()
@@ -44,6 +58,60 @@ func TestReproduceOoM(t *testing.T) {
 	_ = testee.Wait()
 }
 
+func driveViaHttp(t *testing.T, childOutReader *bufio.Reader) {
+	addr := os.Getenv(envHttpAddr)
+	if addr == "" {
+		addr = defaultHttpAddr
+	}
+	baseUrl := "http://" + addr
+
+	// no more "DONE*" lines to wait for, but the testee blocks when its stdout is not consumed
+	iteration := -1
+	var iterationMu sync.Mutex
+	go func() {
+		for {
+			input, err := childOutReader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(input, "PROGRESS ") {
+				iterationMu.Lock()
+				r := iteration
+				iterationMu.Unlock()
+				gatherProgressStats(t, r, strings.TrimSpace(strings.TrimPrefix(input, "PROGRESS ")))
+			}
+			_, _ = os.Stderr.WriteString("### oom-stdout: " + input + "\n")
+		}
+	}()
+
+	for r := 0; r < totalRuns; r++ {
+		_, _ = os.Stdout.WriteString(fmt.Sprintf("starting run: %d\n", r))
+		_ = os.Stdout.Sync()
+		iterationMu.Lock()
+		iteration = r
+		iterationMu.Unlock()
+
+		// the Transport decodes the gzip stream transparently - a truncated dump fails its checksum
+		resp, err := http.Get(baseUrl + "/dumpdb")
+		if assert.Nilf(t, err, "GET /dumpdb failed: %+v", err) {
+			n, err := io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			assert.Equalf(t, http.StatusOK, resp.StatusCode, "GET /dumpdb: %s", resp.Status)
+			assert.Nilf(t, err, "reading /dumpdb response failed after %d bytes: %+v", n, err)
+		}
+
+		time.Sleep(2 * time.Second) // allow garbage collection to happen
+		gatherProcStats(t)
+	}
+	printProcStats()
+	printProgressStats()
+
+	resp, err := http.Post(baseUrl+"/shutdown", "text/plain", nil)
+	if assert.Nilf(t, err, "POST /shutdown failed: %+v", err) {
+		_ = resp.Body.Close()
+	}
+}
+
 var memStats = make([]*ProcessStatEntry, 0, totalRuns+1)
 
 func gatherProcStats(t *testing.T) {
@@ -58,8 +126,28 @@ func printProcStats() {
 	_ = os.Stdout.Sync()
 }
 
+var progressStats = make([]*ProgressEntry, 0, totalRuns*20)
+var progressStatsMu sync.Mutex
+
+// sampling process stats along the testee's "PROGRESS*" lines shows where within an iteration memory jumps
+func gatherProgressStats(t *testing.T, iteration int, progress string) {
+	ps := getProcessStats(t)
+	progressStatsMu.Lock()
+	defer progressStatsMu.Unlock()
+	progressStats = append(progressStats, &ProgressEntry{iteration, progress, ps})
+}
+
+func printProgressStats() {
+	progressStatsMu.Lock()
+	defer progressStatsMu.Unlock()
+	for _, p := range progressStats {
+		_, _ = os.Stdout.WriteString(fmt.Sprintf("    %d: %s => %+v\n", p.iteration, p.progress, p.stats))
+	}
+	_ = os.Stdout.Sync()
+}
+
 // waiting for "DONE*" ...
-func waitForTestee(t *testing.T, scanner *bufio.Reader) {
+func waitForTestee(t *testing.T, scanner *bufio.Reader, iteration int) {
 	done := false
 	for !done {
 		input, err := scanner.ReadString('\n')
@@ -67,6 +155,9 @@ func waitForTestee(t *testing.T, scanner *bufio.Reader) {
 			assert.Failf(t, "Failed to read child stdout", "%+v", err)
 		}
 		done = strings.HasPrefix(input, "DONE")
+		if strings.HasPrefix(input, "PROGRESS ") {
+			gatherProgressStats(t, iteration, strings.TrimSpace(strings.TrimPrefix(input, "PROGRESS ")))
+		}
 		_, _ = os.Stderr.WriteString("### oom-stdout: " + input + "\n")
 	}
 }
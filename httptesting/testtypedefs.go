@@ -4,3 +4,9 @@ type ProcessStatEntry struct {
 	mem string
 	fh  string
 }
+
+type ProgressEntry struct {
+	iteration int
+	progress  string
+	stats     *ProcessStatEntry
+}
@@ -0,0 +1,254 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"gopkg.in/errgo.v2/errors"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+ * compresses a dump - trades cpu for size, e.g. `none` or `gzip-1` keep a snapshot window short, `pgzip` spreads the
+ * work over several cores. all gzip variants are read by Restore (resp. zcat) alike.
+ */
+type Codec interface {
+	Name() string // e.g. "gzip-9" - also part of the dump file name, see CodecByName
+	// appended to the dump file name, "" when uncompressed
+	FileExt() string
+	// of a http response carrying the compressed dump, "" when uncompressed
+	ContentEncoding() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+var CodecNone Codec = &noneCodec{}
+
+// compress/gzip at its default level
+var CodecGzip Codec = &gzipCodec{level: gzip.DefaultCompression}
+
+// gzip in independently compressed blocks, one member per block - as many blocks in flight as cores
+var CodecParallelGzip Codec = &parallelGzipCodec{level: gzip.DefaultCompression}
+
+var DefaultCodec = CodecGzip
+
+// the gzip variants take an optional level suffix: `gzip-1` (fastest) .. `gzip-9` (best)
+var codecs = []Codec{CodecNone, CodecGzip, CodecParallelGzip}
+
+func CodecByName(name string) (Codec, error) {
+	baseName, level, hasLevel := name, gzip.DefaultCompression, false
+	if i := strings.LastIndexByte(name, '-'); i > 0 {
+		l, err := strconv.Atoi(name[i+1:])
+		if err != nil || l < gzip.BestSpeed || l > gzip.BestCompression {
+			return nil, errors.New(fmt.Sprintf("invalid compression level in %q - expected %d..%d", name, gzip.BestSpeed, gzip.BestCompression))
+		}
+		baseName, level, hasLevel = name[:i], l, true
+	}
+
+	names := make([]string, 0, len(codecs))
+	for _, c := range codecs {
+		if !strings.EqualFold(c.Name(), baseName) {
+			names = append(names, c.Name())
+			continue
+		}
+		switch c.(type) {
+		case *gzipCodec:
+			return &gzipCodec{level: level}, nil
+		case *parallelGzipCodec:
+			return &parallelGzipCodec{level: level}, nil
+		}
+		if hasLevel {
+			return nil, errors.New(fmt.Sprintf("codec %q takes no compression level", c.Name()))
+		}
+		return c, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unknown codec %q - expected one of: %s (gzip variants with optional level suffix, e.g. gzip-9)", name, strings.Join(names, ", ")))
+}
+
+type noneCodec struct{}
+
+func (c *noneCodec) Name() string {
+	return "none"
+}
+
+func (c *noneCodec) FileExt() string {
+	return ""
+}
+
+func (c *noneCodec) ContentEncoding() string {
+	return ""
+}
+
+// buffered like the gzip writers - dumps write row by row
+func (c *noneCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flushingWriteCloser{bufio.NewWriterSize(w, 1<<16)}, nil
+}
+
+type flushingWriteCloser struct {
+	*bufio.Writer
+}
+
+func (fw flushingWriteCloser) Close() error {
+	return fw.Flush()
+}
+
+type gzipCodec struct {
+	level int
+}
+
+func gzipCodecName(baseName string, level int) string {
+	if level == gzip.DefaultCompression {
+		return baseName
+	}
+	return fmt.Sprintf("%s-%d", baseName, level)
+}
+
+func (c *gzipCodec) Name() string {
+	return gzipCodecName("gzip", c.level)
+}
+
+func (c *gzipCodec) FileExt() string {
+	return ".gz"
+}
+
+func (c *gzipCodec) ContentEncoding() string {
+	return "gzip"
+}
+
+func (c *gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.level)
+}
+
+const defaultGzipBlockSize = 1 << 20
+
+type parallelGzipCodec struct {
+	level     int
+	blockSize int // defaultGzipBlockSize if 0
+	workers   int // runtime.GOMAXPROCS if 0
+}
+
+func (c *parallelGzipCodec) Name() string {
+	return gzipCodecName("pgzip", c.level)
+}
+
+func (c *parallelGzipCodec) FileExt() string {
+	return ".gz"
+}
+
+func (c *parallelGzipCodec) ContentEncoding() string {
+	return "gzip"
+}
+
+func (c *parallelGzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	// fail early on an invalid level rather than in a worker
+	_, err := gzip.NewWriterLevel(io.Discard, c.level)
+	if err != nil {
+		return nil, err
+	}
+	blockSize, workers := c.blockSize, c.workers
+	if blockSize <= 0 {
+		blockSize = defaultGzipBlockSize
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	pw := &parallelGzipWriter{w: w, level: c.level, blockSize: blockSize, queue: make(chan chan []byte, workers), done: make(chan struct{})}
+	go pw.writeBlocks()
+	return pw, nil
+}
+
+/*
+ * buffers blockSize bytes, compresses each block into a gzip member of its own in a separate goroutine and writes the
+ * members in order. at most cap(queue) blocks are compressed at a time, so a slow w slows down Write.
+ */
+type parallelGzipWriter struct {
+	w         io.Writer
+	level     int
+	blockSize int
+	buf       []byte
+	blocks    int
+	closed    bool
+	queue     chan chan []byte // compressed blocks in order
+	done      chan struct{}    // writeBlocks finished
+
+	mu  sync.Mutex
+	err error // first error of w
+}
+
+func (pw *parallelGzipWriter) Write(p []byte) (int, error) {
+	if err := pw.writeErr(); err != nil {
+		return 0, err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		if pw.buf == nil {
+			pw.buf = make([]byte, 0, pw.blockSize)
+		}
+		chunk := pw.blockSize - len(pw.buf)
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+		pw.buf = append(pw.buf, p[:chunk]...)
+		p = p[chunk:]
+		if len(pw.buf) == pw.blockSize {
+			pw.compressBlock()
+		}
+	}
+	return n, nil
+}
+
+// an empty dump still is a valid (empty) gzip stream
+func (pw *parallelGzipWriter) Close() error {
+	if pw.closed {
+		return pw.writeErr()
+	}
+	pw.closed = true
+	if len(pw.buf) > 0 || pw.blocks == 0 {
+		pw.compressBlock()
+	}
+	close(pw.queue)
+	<-pw.done
+	return pw.writeErr()
+}
+
+func (pw *parallelGzipWriter) compressBlock() {
+	block := pw.buf
+	pw.buf = nil
+	pw.blocks++
+	compressed := make(chan []byte, 1)
+	pw.queue <- compressed
+	go func() {
+		var out bytes.Buffer
+		out.Grow(len(block) / 2)
+		gw, _ := gzip.NewWriterLevel(&out, pw.level) // level checked by NewWriter
+		_, _ = gw.Write(block)                       // a bytes.Buffer does not fail
+		_ = gw.Close()
+		compressed <- out.Bytes()
+	}()
+}
+
+func (pw *parallelGzipWriter) writeBlocks() {
+	defer close(pw.done)
+	for compressed := range pw.queue {
+		block := <-compressed
+		if pw.writeErr() != nil {
+			continue // drain
+		}
+		_, err := pw.w.Write(block)
+		if err != nil {
+			pw.mu.Lock()
+			pw.err = err
+			pw.mu.Unlock()
+		}
+	}
+}
+
+func (pw *parallelGzipWriter) writeErr() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.err
+}
@@ -0,0 +1,240 @@
+package database
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const csvManifestName = "manifest.json"
+
+/*
+ * describes a csv export - the first entry of its archive
+ */
+type CsvManifest struct {
+	Format    string             `json:"format"`
+	Version   int                `json:"version"`
+	CreatedAt time.Time          `json:"createdAt"`
+	Encoding  map[string]string  `json:"encoding"` // how values are represented
+	Codec     string             `json:"codec"`    // the archive got compressed with, see CodecByName
+	Tables    []CsvManifestTable `json:"tables"`
+}
+
+type CsvManifestTable struct {
+	Table   string              `json:"table"`
+	Where   string              `json:"where,omitempty"` // the rows exported, all if empty - see DumpFilter
+	File    string              `json:"file"`
+	Columns []CsvManifestColumn `json:"columns"`
+	Rows    int64               `json:"rows"`
+	Bytes   int64               `json:"bytes"`
+	Sha256  string              `json:"sha256"`
+}
+
+type CsvManifestColumn struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Affinity Affinity `json:"affinity"`
+	Masked   string   `json:"masked,omitempty"` // the mask method its values got replaced by, see Masking
+}
+
+var csvEncoding = map[string]string{
+	"dialect": "RFC 4180, CRLF line breaks, header row of column names",
+	"null":    "empty unquoted field",
+	"text":    "always quoted, an empty text is \"\"",
+	"integer": "unquoted decimal",
+	"real":    "unquoted, 17 significant digits, Infinity/-Infinity",
+	"blob":    "unquoted hex with 0x prefix, e.g. 0x00FF",
+}
+
+var csvFileNameInvalidChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+/*
+ * writes a tar archive: manifest.json, then one csv per table. as a tar entry needs its size upfront, each csv is
+ * written to a temp file first.
+ */
+func csvDump(ctx context.Context, db *sql.DB, w io.Writer, codecName string, filter *DumpFilter, masking *Masking, progress ProgressFunc) error {
+	schema, err := getDumpSchema(ctx, db, filter, masking)
+	if err != nil {
+		return err
+	}
+
+	manifest := &CsvManifest{Format: string(FormatCsv), Version: 1, CreatedAt: time.Now().UTC(), Encoding: csvEncoding, Codec: codecName}
+	tempFiles := make([]string, 0, len(schema.tables))
+	defer func() {
+		for _, f := range tempFiles {
+			_ = tempSpace.removeTemp(f)
+		}
+	}()
+
+	usedFileNames := make(map[string]bool)
+	for _, table := range schema.tables {
+		tableInfo, err := getTableInfo(ctx, db, table.name)
+		if err != nil {
+			return err
+		}
+		entry := CsvManifestTable{Table: table.name, Where: table.where, File: csvFileName(table.name, usedFileNames)}
+		for i, ci := range tableInfo.columnInfos {
+			entry.Columns = append(entry.Columns, CsvManifestColumn{Name: ci.colName, Type: ci.colType, Affinity: ci.affinity, Masked: table.masker.method(i)})
+		}
+
+		file, err := tempSpace.createTemp(".export-*.csv")
+		if err != nil {
+			return err
+		}
+		tempFiles = append(tempFiles, file.Name())
+		err = writeCsvTable(ctx, db, table, tableInfo, file, &entry, progress)
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		manifest.Tables = append(manifest.Tables, entry)
+	}
+
+	tw := tar.NewWriter(w)
+	manifestJson, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{Name: csvManifestName, Mode: 0o644, Size: int64(len(manifestJson)), ModTime: manifest.CreatedAt})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(manifestJson)
+	if err != nil {
+		return err
+	}
+	for i, entry := range manifest.Tables {
+		err = addTarFile(tw, tempFiles[i], entry.File, entry.Bytes, manifest.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeCsvTable(ctx context.Context, db *sql.DB, table *SchemaEntry, tableInfo *TableInfo, file *os.File, entry *CsvManifestTable, progress ProgressFunc) error {
+	h := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(file, h)}
+	bw := bufio.NewWriterSize(counter, 1<<16)
+
+	var sb strings.Builder
+	for i, ci := range tableInfo.columnInfos {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		appendCsvText(&sb, ci.colName)
+	}
+	sb.WriteString("\r\n")
+	_, err := bw.WriteString(sb.String())
+	if err != nil {
+		return err
+	}
+
+	err = forEachRow(ctx, db, table, tableInfo, progress, func(vals []interface{}) error {
+		sb.Reset()
+		for i, v := range vals {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			appendCsvValue(&sb, v)
+		}
+		sb.WriteString("\r\n")
+		entry.Rows++
+		_, err := bw.WriteString(sb.String())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+	entry.Bytes = counter.n
+	entry.Sha256 = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+func appendCsvValue(sb *strings.Builder, v interface{}) {
+	switch val := v.(type) {
+	case nil:
+	case int64:
+		sb.WriteString(strconv.FormatInt(val, 10))
+	case float64:
+		switch {
+		case math.IsInf(val, 1):
+			sb.WriteString("Infinity")
+		case math.IsInf(val, -1):
+			sb.WriteString("-Infinity")
+		default:
+			sb.WriteString(strconv.FormatFloat(val, 'g', 17, 64))
+		}
+	case []byte:
+		sb.WriteString("0x")
+		sb.WriteString(strings.ToUpper(hex.EncodeToString(val)))
+	case string:
+		appendCsvText(sb, val)
+	default:
+		appendCsvText(sb, fmt.Sprint(val))
+	}
+}
+
+func appendCsvText(sb *strings.Builder, s string) {
+	sb.WriteByte('"')
+	sb.WriteString(strings.ReplaceAll(s, "\"", "\"\""))
+	sb.WriteByte('"')
+}
+
+/*
+ * a file name safe within the archive - tables whose names differ only in invalid chars get a numbered suffix
+ */
+func csvFileName(tableName string, used map[string]bool) string {
+	base := csvFileNameInvalidChars.ReplaceAllString(tableName, "_")
+	name := base + ".csv"
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%s-%d.csv", base, i)
+	}
+	used[name] = true
+	return name
+}
+
+func addTarFile(tw *tar.Writer, fileName string, name string, size int64, modTime time.Time) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: size, ModTime: modTime})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
@@ -10,26 +11,84 @@ import (
 
 var MyDb *sql.DB
 
+// the (empty) file naming MyDb
+var myDbFile string
+
 /**
  * creates an empty db and applies the schema
  * NOTE: all initDb code takes any error as fatal
  */
 func InitDB() {
-	file, err := os.CreateTemp("tmp", ".oom-*.db")
+	var err error
+	MyDb, myDbFile, err = openMemDb()
+	if err != nil {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("cannot create db - err: %+v", err) + "\n")
+		Exit(1)
+	}
+	createSchema(MyDb)
+}
+
+/*
+ * closes MyDb as of now - LOAD may have replaced the one opened by InitDB
+ */
+func CloseMyDb() error {
+	myDbMu.Lock()
+	defer myDbMu.Unlock()
+	if MyDb == nil {
+		return nil
+	}
+	err := MyDb.Close()
+	_ = tempSpace.removeTemp(myDbFile)
+	return err
+}
+
+func openMemDb() (*sql.DB, string, error) {
+	file, err := tempSpace.createTemp(".oom-*.db")
 	if err != nil {
-		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("cannot create temporary db file - err: %+v", err) + "\n")
-		os.Exit(1)
+		return nil, "", err
 	}
 	_ = file.Close()
 
 	connStr := fmt.Sprintf("file:%s?mode=memory&cache=private&_fk=1&_journal_mode=OFF&_locking=EXCLUSIVE&_mutex=no", file.Name())
-	MyDb, err = sql.Open("sqlite3", connStr)
+	db, err := sql.Open("sqlite3", connStr)
 	if err != nil {
-		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("cannot create db - err: %+v", err) + "\n")
-		os.Exit(1)
+		_ = tempSpace.removeTemp(file.Name())
+		return nil, "", err
 	}
-	MyDb.SetMaxOpenConns(10)
-	createSchema(MyDb)
+	db.SetMaxOpenConns(10)
+	return db, file.Name(), nil
+}
+
+/*
+ * replaces MyDb by a new one restored from a dump file (resp. the dumps of a chain manifest, see RestoreChain) - MyDb
+ * stays as it is if the restore fails
+ */
+func LoadDB(ctx context.Context, dumpFile string, opts *RestoreOptions) (*RestoreResult, error) {
+	if _, err := os.Stat(dumpFile); err != nil {
+		return nil, err
+	}
+	db, dbFile, err := openMemDb()
+	if err != nil {
+		return nil, err
+	}
+	res, err := restoreFile(ctx, db, dumpFile, opts)
+	if err != nil {
+		_ = db.Close()
+		_ = tempSpace.removeTemp(dbFile)
+		return res, err
+	}
+
+	// no snapshot of the old db may be in progress
+	myDbMu.Lock()
+	oldDb, oldDbFile := MyDb, myDbFile
+	MyDb, myDbFile = db, dbFile
+	myDbMu.Unlock()
+
+	if oldDb != nil {
+		_ = oldDb.Close()
+		_ = tempSpace.removeTemp(oldDbFile)
+	}
+	return res, nil
 }
 
 func createSchema(db *sql.DB) {
@@ -102,6 +161,6 @@ func execStmtFatalOnErr(db *sql.DB, stmt string) {
 	_, err := db.Exec(strippedStmt)
 	if err != nil {
 		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("failed db schema generation: stmt=%s - err: %+v", strippedStmt, err) + "\n")
-		os.Exit(1)
+		Exit(1)
 	}
 }
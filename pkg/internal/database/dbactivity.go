@@ -1,7 +1,6 @@
 package database
 
 import (
-	"compress/gzip"
 	"context"
 	"database/sql"
 	"fmt"
@@ -9,30 +8,175 @@ import (
 	"gopkg.in/errgo.v2/errors"
 	"io"
 	"os"
+	"sort"
+	"strings"
 	"time"
 )
 
 const ActivityDump = "DUMP"
 const ActivityNone = "NONE"
 const ActivityOther = "OTHER"
+const ActivityStream = "STREAM" // see StreamDump
 
 var invalidDbActivityCmd = errors.New("invalid db activity command - expected: DUMP, OTHER, NONE")
 
+/*
+ * tunes how an activity is carried out - nil options are replaced by DefaultActivityOptions()
+ */
+type ActivityOptions struct {
+	Strategy   SnapshotStrategy
+	CopyMethod SnapshotCopyMethod
+	Retry      RetryPolicy
+	Stepping   StepPolicy
+	Verify     VerifyMode
+	Format     DumpFormat     // of ActivityDump
+	Codec      Codec          // compresses the dump of ActivityDump
+	SqlDump    SqlDumpOptions // of FormatSql
+	// tables of a FormatSql dump dumped at a time, each on a connection of its own - <= 1: sequential. takes a
+	// snapshot readable by several connections (file based: StrategyTempFile, CopyVacuumInto), else sequential anyway
+	DumpWorkers int
+	Progress    ProgressFunc     // optional, called synchronously from the activity
+	Snapshots   *SnapshotManager // optional, activities share a leased snapshot instead of creating their own
+	Chain       *DumpChain       // optional, ActivityDump writes the next dump of the chain (sql only) - StreamDump ignores it
+	Filter      *DumpFilter      // optional, the tables and rows to dump - all if nil
+	Masking     *Masking         // optional, replaces the values of sensitive columns in the dump
+}
+
+func DefaultActivityOptions() *ActivityOptions {
+	return &ActivityOptions{
+		Strategy:   DefaultSnapshotStrategy,
+		CopyMethod: DefaultCopyMethod,
+		Retry:      DefaultRetryPolicy,
+		Stepping:   DefaultStepPolicy,
+		Verify:     VerifyOff,
+		Format:     DefaultDumpFormat,
+		Codec:      DefaultCodec,
+	}
+}
+
+/*
+ * what an activity did - also returned (as far as it got) when the activity failed
+ */
+type ActivityResult struct {
+	Cmd              string
+	Strategy         string
+	Overridden       string // the configured strategy, if the copy method replaced it by Strategy
+	CopyMethod       SnapshotCopyMethod
+	Attempts         int                 // snapshot attempts incl. retries
+	SnapshotDuration time.Duration       // all attempts incl. backoff
+	Steps            []BackupStep        // backup steps of the last snapshot attempt
+	Verification     *VerificationResult // nil if not verified
+	Duration         time.Duration
+	RssBefore        int64      // process rss in bytes before the activity, -1 if unknown
+	RssSnapshot      int64      // ... with the snapshot in place
+	RssAfter         int64      // ... after the snapshot got disposed
+	SnapshotBytes    int64      // size of the snapshot db
+	SqliteFreed      int64      // by sqlite on disposing a snapshot held in memory, -1 if not measured - see Snapshot.Freed
+	Format           DumpFormat // of DumpFile
+	Codec            string     // DumpFile got compressed with
+	DumpWorkers      int        // tables dumped at a time, 1 if sequential
+	DumpFile         string     // the dump written by ActivityDump, "" if none
+	ChainManifest    string     // of the chain DumpFile belongs to, "" if none (see ActivityOptions.Chain)
+	ChainDump        *ChainDump // DumpFile's entry in ChainManifest
+}
+
+func (r *ActivityResult) StepSummary() StepSummary {
+	return summarizeSteps(r.Steps)
+}
+
+func (r *ActivityResult) String() string {
+	sum := r.StepSummary()
+	return fmt.Sprintf("cmd=%s strategy=%s copy=%s attempts=%d snapshot=%s steps=%d pages=%d..%d stepAvg=%s stepMax=%s total=%s",
+		r.Cmd, r.strategyString(), r.CopyMethod, r.Attempts, r.SnapshotDuration.Round(time.Millisecond), sum.Steps, sum.MinPages,
+		sum.MaxPages, sum.AvgDuration.Round(time.Microsecond), sum.MaxDuration.Round(time.Microsecond),
+		r.Duration.Round(time.Millisecond)) + fmt.Sprintf(" rssKB=%d/%d/%d", r.RssBefore/1024, r.RssSnapshot/1024, r.RssAfter/1024) +
+		r.freedString() + r.verificationString() + r.dumpString()
+}
+
+// e.g. ` freedKB=120/4096 WARNING=snapshot-memory-not-released` - nothing unless measured
+func (r *ActivityResult) freedString() string {
+	if r.SqliteFreed < 0 {
+		return ""
+	}
+	s := fmt.Sprintf(" freedKB=%d/%d", r.SqliteFreed/1024, r.SnapshotBytes/1024)
+	if !memoryReleased(r.SqliteFreed, r.SnapshotBytes) {
+		s += " WARNING=snapshot-memory-not-released"
+	}
+	return s
+}
+
+// e.g. `vacuum(overrides:memory)`
+func (r *ActivityResult) strategyString() string {
+	if r.Overridden == "" {
+		return r.Strategy
+	}
+	return fmt.Sprintf("%s(overrides:%s)", r.Strategy, r.Overridden)
+}
+
+func (r *ActivityResult) dumpString() string {
+	if r.DumpFile == "" {
+		return ""
+	}
+	s := fmt.Sprintf(" dump(%s,%s)=%s", r.Format, r.Codec, r.DumpFile)
+	if r.DumpWorkers > 1 {
+		s += fmt.Sprintf(" workers=%d", r.DumpWorkers)
+	}
+	if r.ChainDump != nil {
+		s += fmt.Sprintf(" chain=%s %s", r.ChainManifest, r.ChainDump)
+	}
+	return s
+}
+
+func (r *ActivityResult) verificationString() string {
+	if r.Verification == nil {
+		return ""
+	}
+	return " " + r.Verification.String()
+}
+
+// a copy of opts with unset fields replaced by their defaults
+func (opts *ActivityOptions) withDefaults() *ActivityOptions {
+	if opts == nil {
+		return DefaultActivityOptions()
+	}
+	o := *opts
+	if o.Strategy == nil {
+		o.Strategy = DefaultSnapshotStrategy
+	}
+	if o.CopyMethod == "" {
+		o.CopyMethod = DefaultCopyMethod
+	}
+	if o.Format == "" {
+		o.Format = DefaultDumpFormat
+	}
+	if o.Codec == nil {
+		o.Codec = DefaultCodec
+	}
+	return &o
+}
+
 /*
  * as dumping a db to sql stmts is a fairly slow process, the export first makes an in-memory backup (snapshot) of the
  * database, which can then be dumped without blocking the main db for regular usage (e.g. UI requests)
  * as snapshotting is non-invasive, meaning it offers time slots for requests to happen, it may fail when such requests
- * update/change the database => export could be retried ... done so in our productive project
+ * update/change the database => the snapshot is retried according to opts.Retry. when it finally fails, a *SnapshotError
+ * is returned, so the caller may decide to carry on
+ * cancelling ctx aborts the snapshot between two page chunks resp. the dump between two rows and removes any temp
+ * snapshot or partially written dump file
  */
-func Activity(cmd string) error {
-	_, _ = os.Stdout.WriteString(">>> oom: " + ("starting export ...\n") + "\n")
-
-	// "snapshotting from in-memory db to another in-memory db (using distinct file urls) seems to be the root trigger for the observed memory leak
-	err := withSnapshotDo(func(dbToBackup *sql.DB) error {
+func Activity(ctx context.Context, cmd string, opts *ActivityOptions) (*ActivityResult, error) {
+	return activity(ctx, cmd, opts, func(snap *Snapshot, opts *ActivityOptions, res *ActivityResult) error {
 		if cmd == ActivityDump {
+			readers, closeReaders := openDumpReaders(snap, opts, res)
+			defer closeReaders()
 			// original code to observe described memoey leak - intense db activity seems to make the memory leak more "obvious"
 			// => almost every iteration shows a memory growth
-			return dumpToFile(dbToBackup) // snapshot db activity
+			if opts.Chain != nil {
+				return opts.Chain.dump(ctx, snap.DB(), readers, opts, res)
+			}
+			var err error
+			res.DumpFile, err = dumpToFile(ctx, snap.DB(), readers, opts) // snapshot db activity
+			return err
 
 		} else if cmd == ActivityNone {
 			// snapshot only without any activity on that snapshot
@@ -44,13 +188,82 @@ func Activity(cmd string) error {
 
 		return nil
 	})
+}
+
+/*
+ * like Activity(ctx, ActivityDump, opts), but streams the compressed dump (see opts.Codec) into w instead of a file - e.g. a http
+ * response. a failing w (e.g. the client went away) aborts the dump, its error is returned.
+ */
+func StreamDump(ctx context.Context, w io.Writer, opts *ActivityOptions) (*ActivityResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// dump writers take write errors as fatal - so rather discard any further output and let the dump end on ctx
+	sw := &stopOnErrWriter{w: w, stop: cancel}
+	res, err := activity(ctx, ActivityStream, opts, func(snap *Snapshot, opts *ActivityOptions, res *ActivityResult) error {
+		// the codec writes its header even for an empty dump - a filter or masking not fitting has to fail before
+		_, err := getDumpSchema(ctx, snap.DB(), opts.Filter, opts.Masking)
+		if err != nil {
+			return err
+		}
+		readers, closeReaders := openDumpReaders(snap, opts, res)
+		defer closeReaders()
+		cw, err := opts.Codec.NewWriter(sw)
+		if err != nil {
+			return err
+		}
+		err = opts.Format.dump(ctx, snap.DB(), readers, cw, opts)
+		closeErr := cw.Close()
+		if err == nil {
+			err = closeErr
+		}
+		return err
+	})
+	if sw.err != nil {
+		return res, sw.err
+	}
+	return res, err
+}
+
+type stopOnErrWriter struct {
+	w    io.Writer
+	stop context.CancelFunc
+	err  error
+}
+
+func (sw *stopOnErrWriter) Write(p []byte) (int, error) {
+	if sw.err != nil {
+		return len(p), nil
+	}
+	_, err := sw.w.Write(p)
+	if err != nil {
+		sw.err = err
+		sw.stop()
+	}
+	return len(p), nil
+}
+
+func activity(ctx context.Context, cmd string, opts *ActivityOptions, exec func(snap *Snapshot, opts *ActivityOptions, res *ActivityResult) error) (*ActivityResult, error) {
+	opts = opts.withDefaults()
+	start := time.Now()
+	res := &ActivityResult{Cmd: cmd, Strategy: opts.Strategy.Name(), CopyMethod: opts.CopyMethod, Format: opts.Format, Codec: opts.Codec.Name(), RssBefore: processRss(), SqliteFreed: -1}
+	defer func() {
+		res.Duration = time.Since(start)
+		res.RssAfter = processRss()
+	}()
+	_, _ = os.Stdout.WriteString(">>> oom: " + ("starting export ...\n") + "\n")
+
+	// "snapshotting from in-memory db to another in-memory db (using distinct file urls) seems to be the root trigger for the observed memory leak
+	// => see StrategyPrivateMemory vs. StrategyTempFile (WORKAROUND)
+	err := withSnapshotDo(ctx, opts, res, func(snap *Snapshot) error {
+		return exec(snap, opts, res)
+	})
 
 	// VERIFICATION check: dump from main db, so NOT using "snapshotting" => no memory leak!
-	//err := dumpToFile(MyDb)
+	//res.DumpFile, err = dumpToFile(ctx, MyDb, nil, opts)
 
 	if err != nil {
 		_, _ = os.Stdout.WriteString(">>> oom: " + ("failed to dump db") + "\n")
-		return err
+		return res, err
 	}
 
 	// ??? PRAGMA shrink_memory: does not seem to have any impact on memory growth observation
@@ -60,79 +273,132 @@ func Activity(cmd string) error {
 	//}
 
 	_, _ = os.Stdout.WriteString(">>> oom: " + ("done export\n") + "\n")
-	return nil
+	return res, nil
 }
 
-func dumpToFile(dbToBackup *sql.DB) error {
+/*
+ * returns the name of the completed dump file - readers (optional) are further connections to dbToBackup for a parallel
+ * dump, see openDumpReaders
+ */
+func dumpToFile(ctx context.Context, dbToBackup *sql.DB, readers *sql.DB, opts *ActivityOptions) (string, error) {
+	format, codec := opts.Format, opts.Codec
 	ts := time.Now().Format("20060102150405")
-	dumpfile, err := os.CreateTemp("tmp", fmt.Sprintf("dump-%s-*.sql.gz", ts))
-	if err != nil {
-		return err
-	}
-	defer dumpfile.Close()
-
-	gw := gzip.NewWriter(dumpfile)
-	defer gw.Close()
-
-	// ORIG using github.com/schollz/sqlite3dump to dump db
-	// err = sqlite3dump.DumpDB(dbToBackup, gw, sqlite3dump.WithMigration())
-	err = alternativeDump(dbToBackup, gw)
-	return err
+	return writeDumpFile(fmt.Sprintf("dump-%s-%s-*", ts, codec.Name())+format.fileExt(), codec, func(w io.Writer) error {
+		// ORIG using github.com/schollz/sqlite3dump to dump db
+		// err = sqlite3dump.DumpDB(dbToBackup, gw, sqlite3dump.WithMigration())
+		return format.dump(ctx, dbToBackup, readers, w, opts)
+	})
 }
 
-func withSnapshotDo(exec func(snapshot *sql.DB) error) error {
-	file, err := os.CreateTemp("tmp", ".snapshot-*.db")
+/*
+ * creates a file in the temp space named after pattern (see os.CreateTemp) plus the codec's extension and lets write
+ * fill it through the codec. the file is written as `*.partial` and renamed once complete - removed if write fails.
+ */
+func writeDumpFile(pattern string, codec Codec, write func(w io.Writer) error) (fileName string, err error) {
+	dumpfile, err := tempSpace.createTemp(pattern + codec.FileExt() + partialSuffix)
+	if err != nil {
+		return "", err
+	}
+	fileName = strings.TrimSuffix(dumpfile.Name(), partialSuffix)
+	cw, err := codec.NewWriter(dumpfile)
 	if err != nil {
-		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("cannot create temporary snapshotDb file - err: %+v", err) + "\n")
+		_ = dumpfile.Close()
+		_ = tempSpace.removeTemp(dumpfile.Name())
+		return "", err
 	}
-	_ = file.Close()
 	defer func() {
-		err2 := os.RemoveAll(file.Name())
-		if err2 != nil {
-			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("failed to remove temp snapshot db file %s", file.Name()) + "\n")
+		_ = cw.Close()
+		closeErr := dumpfile.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = tempSpace.keep(dumpfile.Name(), fileName)
+		}
+		if err != nil {
+			fileName = ""
+			// a partial dump is of no use - e.g. when cancelled
+			err2 := tempSpace.removeTemp(dumpfile.Name())
+			if err2 != nil {
+				_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("failed to remove partial dump file %s", dumpfile.Name()) + "\n")
+			}
 		}
 	}()
 
-	// ORIG:
-	snapshotConnStr := fmt.Sprintf("file:%s?mode=memory&cache=private&_journal_mode=OFF&_fk=off&_query_only=true&_locking=EXCLUSIVE&_mutex=no", file.Name())
-
-	// TESTING some conn str uri params => no effect - still memory leaking
-	// snapshotConnStr := fmt.Sprintf("file:%s?mode=memory&cache=private&_journal_mode=OFF&_fk=off&_mutex=no", file.Name())
-
-	// WORKAROUND: using file based db instead of in-mem (mode=rwc) => slower when creating snapshot db:
-	//snapshotConnStr := fmt.Sprintf("file:%s?mode=rwc&cache=private&_journal_mode=OFF&_fk=off&_query_only=true&_locking=EXCLUSIVE&_mutex=no", file.Name())
+	err = write(cw)
+	if err == nil {
+		err = cw.Close()
+	}
+	return fileName, err
+}
 
-	// >>> proposed in https://github.com/mattn/go-sqlite3/issues/1005#issuecomment-1019029882 : use `:memory:`instead of temp file name
-	//     => no impact on increasing memory consumption behavior
-	//snapshotConnStr := "file::memory:?mode=memory&cache=private&_journal_mode=OFF&_fk=off&_query_only=true&_locking=EXCLUSIVE&_mutex=no"
+func withSnapshotDo(ctx context.Context, opts *ActivityOptions, res *ActivityResult, exec func(snap *Snapshot) error) error {
+	if opts.Snapshots != nil {
+		return withSnapshotLeaseDo(ctx, opts.Snapshots, res, exec)
+	}
 
-	snapshotDb, err := sql.Open("sqlite3", snapshotConnStr)
+	snap, err := OpenSnapshot(ctx, opts)
+	res.Strategy = snap.Strategy().Name()
+	if overridden := snap.OverriddenStrategy(); overridden != nil {
+		res.Overridden = overridden.Name()
+	}
+	res.Attempts = snap.Attempts()
+	res.Steps = snap.Steps()
+	res.SnapshotDuration = snap.Duration()
+	res.Verification = snap.Verification()
+	res.RssSnapshot = processRss()
 	if err != nil {
-		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("cannot create snapshotDb - err: %+v", err) + "\n")
 		return err
 	}
-	defer snapshotDb.Close()
 
-	snapshotDb.SetMaxOpenConns(1)
+	err = exec(snap)
 
-	err = withSqliteConnDo(snapshotDb, func(snapshotSqliteConn *sqlite3.SQLiteConn) error {
-		return withSqliteConnDo(MyDb, func(srcSqliteConn *sqlite3.SQLiteConn) error {
-			return createDbSnapshot(snapshotSqliteConn, srcSqliteConn)
-		})
-	})
-
-	if err == nil {
-		err = exec(snapshotDb)
+	closeErr := snap.Close()
+	res.SnapshotBytes, res.SqliteFreed = snap.ByteSize(), snap.Freed()
+	if closeErr != nil {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: failed to dispose snapshot - err: %+v", closeErr) + "\n")
+		if err == nil {
+			err = closeErr
+		}
 	}
+	return err
+}
 
+func withSnapshotLeaseDo(ctx context.Context, snapshots *SnapshotManager, res *ActivityResult, exec func(snap *Snapshot) error) error {
+	lease, err := snapshots.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	snap := lease.Snapshot()
+	res.Strategy = snap.Strategy().Name()
+	if overridden := snap.OverriddenStrategy(); overridden != nil {
+		res.Overridden = overridden.Name()
+	}
+	res.CopyMethod = snap.CopyMethod()
+	res.Attempts = snap.Attempts()
+	res.Steps = snap.Steps()
+	res.SnapshotDuration = snap.Duration()
+	res.Verification = snap.Verification()
+	res.RssSnapshot = processRss()
+
+	err = exec(snap)
+
+	releaseErr := lease.Release()
+	res.SnapshotBytes, res.SqliteFreed = snap.ByteSize(), snap.Freed() // -1 while still leased by others
+	if releaseErr != nil {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: failed to dispose shared snapshot - err: %+v", releaseErr) + "\n")
+		if err == nil {
+			err = releaseErr
+		}
+	}
 	return err
 }
 
 /*
  * an accessor to the sqlite3 driver's native connection implementation
  */
-func withSqliteConnDo(db *sql.DB, exec func(sqliteConn *sqlite3.SQLiteConn) error) error {
-	connCtx, cancel := context.WithTimeout(context.Background(), 4*time.Minute)
+func withSqliteConnDo(ctx context.Context, db *sql.DB, exec func(sqliteConn *sqlite3.SQLiteConn) error) error {
+	connCtx, cancel := context.WithTimeout(ctx, 4*time.Minute)
 	defer cancel()
 	conn, err := db.Conn(connCtx)
 	if err != nil {
@@ -147,73 +413,136 @@ func withSqliteConnDo(db *sql.DB, exec func(sqliteConn *sqlite3.SQLiteConn) erro
 	})
 }
 
+const stmtSchema = `SELECT "type", "name", "tbl_name", "sql" 
+		FROM "sqlite_master" 
+		WHERE "sql" NOT NULL 
+		ORDER BY "rowid"`
+
 /*
- * snapshotting uses sqlite's Backup API to copy chunk of pages. the chunk size is limited, not to block the src db for to long.
- * when a db was updated between copying two succeeding chunks, the snapshotting fails => triggers retry mechanism in our production project
+ * an entry of sqlite_master - its sql is the original CREATE statement
  */
-func createDbSnapshot(snaphshotSqliteConn *sqlite3.SQLiteConn, srcSqliteConn *sqlite3.SQLiteConn) error {
-	backup, err := snaphshotSqliteConn.Backup("main", srcSqliteConn, "main") //nolint:govet
-	if err != nil {
-		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: failed to init db backup - err: %+v", err) + "\n")
-		return err
-	}
-	defer backup.Close()
-
-	var done = false
-	for !done && err == nil {
-		done, err = backup.Step(250)
-		if err != nil {
-			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: failed to copy dbPages - err: %+v", err) + "\n")
-			os.Exit(1) // in production code: bubble error and trigger retry ... instead of exiting
-		}
-	}
-	return err
+type SchemaEntry struct {
+	objType string
+	name    string
+	tblName string
+	sql     string
+	where   string     // of a table, the rows to dump - see DumpFilter
+	masker  *rowMasker // of a table with masked columns - see Masking
 }
 
-const stmtTables = `SELECT "name", "type", "sql" 
-		FROM "sqlite_master" 
-		WHERE "sql" NOT NULL AND "type" == 'table' 
-		ORDER BY "name"`
+/*
+ * the schema in restorable order: tables (by name), then - in creation order, so dependencies among them hold -
+ * indexes, triggers and views. sqlite's internal tables (e.g. sqlite_sequence) are not part of it.
+ */
+type Schema struct {
+	tables   []*SchemaEntry
+	indexes  []*SchemaEntry
+	triggers []*SchemaEntry
+	views    []*SchemaEntry
+	internal []*SchemaEntry // tables only sqlite itself creates - their content may still need to be dumped
+}
 
 type ColumnInfo struct {
-	colName string
-	colType string
+	colName  string
+	colType  string
+	affinity Affinity
+	pk       int // position within the primary key, 0 if not part of it
 }
 type TableInfo struct {
 	columnInfos []*ColumnInfo
 }
 
+/*
+ * the zero value writes one INSERT per row within a single transaction
+ */
+type SqlDumpOptions struct {
+	RowsPerInsert  int // rows per INSERT statement (multi-row VALUES list), <= 1: one INSERT per row
+	MaxInsertBytes int // limits a multi-row INSERT statement (a single row may still exceed it), <= 0: defaultMaxInsertBytes
+	CommitEvery    int // COMMIT and BEGIN a new transaction every N INSERT statements, <= 0: a single transaction
+}
+
+// well below sqlite's default SQLITE_MAX_SQL_LENGTH of 1e9 bytes
+const defaultMaxInsertBytes = 1 << 20
+
+/*
+ * writes the INSERT statements and - if configured - intermediate COMMITs of a dump
+ */
+type insWriter struct {
+	file       io.Writer
+	opts       SqlDumpOptions
+	stmts      int
+	stmtLens   []int // of the statements written, if recordLens - see dumpTablesParallel
+	recordLens bool
+}
+
+func (iw *insWriter) maxRows() int {
+	if iw.opts.RowsPerInsert < 1 {
+		return 1
+	}
+	return iw.opts.RowsPerInsert
+}
+
+func (iw *insWriter) maxBytes() int {
+	if iw.opts.MaxInsertBytes <= 0 {
+		return defaultMaxInsertBytes
+	}
+	return iw.opts.MaxInsertBytes
+}
+
+func (iw *insWriter) writeStmt(stmt string) {
+	_, err := io.WriteString(iw.file, stmt)
+	failOnErr("write insStmts", err)
+	if iw.recordLens {
+		iw.stmtLens = append(iw.stmtLens, len(stmt))
+	}
+	iw.stmtWritten()
+}
+
+func (iw *insWriter) stmtWritten() {
+	iw.stmts++
+	if iw.opts.CommitEvery > 0 && iw.stmts%iw.opts.CommitEvery == 0 {
+		_, err := io.WriteString(iw.file, "COMMIT;\nBEGIN TRANSACTION;\n")
+		failOnErr("write intermediate commit", err)
+	}
+}
+
 /**
  * simplified alternative implementation not to depend on github.com/schollz/sqlite3dump
+ * writes a restorable dump: CREATE TABLE statements, the data, then indexes, views and triggers - replaying it on an
+ * empty db recreates the dumped one. triggers come after the data, so the inserts do not fire them, and after the
+ * views, as an INSTEAD OF trigger is created on one.
+ * NOTE: write/query failures are still fatal, only a cancelled ctx is returned as error
  */
-func alternativeDump(db *sql.DB, file io.Writer) error {
-	_, err := file.Write([]byte("BEGIN TRANSACTION;\n"))
+func alternativeDump(ctx context.Context, db *sql.DB, readers *sql.DB, file io.Writer, sqlOpts SqlDumpOptions, filter *DumpFilter, masking *Masking, progress ProgressFunc) error {
+	// like `sqlite3 .dump`: rows go in table by table, regardless of references among them
+	schema, err := getDumpSchema(ctx, db, filter, masking)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write([]byte("PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\n"))
 	failOnErr("write tx begin", err)
 
-	tableNames := getTableNames(db)
-
-	for _, tableName := range tableNames {
-		tableInfo := getTableInfo(db, tableName)
-
-		stmtpartColNames := ""
-		stmtpartColValues := ""
-		for i, ci := range tableInfo.columnInfos {
-			if i > 0 {
-				stmtpartColNames += ", "
-				stmtpartColValues += ", "
-			}
-			stmtpartColNames += "\"" + ci.colName + "\""
-			if ci.colType == "text" {
-				stmtpartColValues += "' || quote(\"" + ci.colName + "\") || '"
-			} else {
-				stmtpartColValues += "' || \"" + ci.colName + "\" || '"
+	dumpDDL("write tables", schema.tables, file)
+
+	iw := &insWriter{file: file, opts: sqlOpts}
+	tables := append(schema.tables, schema.internal...)
+	if readers != nil {
+		err = dumpTablesParallel(ctx, readers, tables, iw, progress)
+	} else {
+		for _, table := range tables {
+			err = dumpTableData(ctx, db, table, iw, progress)
+			if err != nil {
+				break
 			}
 		}
-
-		stmtInsStmts := "SELECT 'INSERT INTO \"" + tableName + "\"(" + stmtpartColNames + ")" +
-			" VALUES(" + stmtpartColValues + ")' from \"" + tableName + "\""
-		dumpInsStmts(db, stmtInsStmts, file)
 	}
+	if err != nil {
+		return err
+	}
+
+	dumpDDL("write indexes", schema.indexes, file)
+	dumpDDL("write views", schema.views, file)
+	dumpDDL("write triggers", schema.triggers, file)
 
 	_, err = file.Write([]byte("COMMIT;\n"))
 	failOnErr("write commit", err)
@@ -221,26 +550,85 @@ func alternativeDump(db *sql.DB, file io.Writer) error {
 	return nil
 }
 
-func getTableNames(db *sql.DB) []string {
-	tableRows, err := db.Query(stmtTables)
-	failOnErr("query tables", err)
-	defer tableRows.Close()
+func dumpDDL(msg string, entries []*SchemaEntry, file io.Writer) {
+	for _, entry := range entries {
+		_, err := file.Write([]byte(entry.sql + ";\n"))
+		failOnErr(msg, err)
+	}
+}
+
+func dumpTableData(ctx context.Context, db *sql.DB, table *SchemaEntry, iw *insWriter, progress ProgressFunc) error {
+	tableName := table.name
+	tableInfo, err := getTableInfo(ctx, db, tableName)
+	if err != nil {
+		return err
+	}
+
+	if table.objType == "table" && tableName == "sqlite_sequence" {
+		// sqlite created it along with the first AUTOINCREMENT table - just replace its content
+		_, err = iw.file.Write([]byte("DELETE FROM \"sqlite_sequence\";\n"))
+		failOnErr("write sqlite_sequence", err)
+	}
+
+	return dumpInsStmts(ctx, db, table, tableInfo, iw, progress)
+}
+
+// *sql.DB, *sql.Conn and *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func getSchema(ctx context.Context, db queryer) (*Schema, error) {
+	schemaRows, err := db.QueryContext(ctx, stmtSchema)
+	if cErr := cancelledErr(ctx, err); cErr != nil {
+		return nil, cErr
+	}
+	failOnErr("query schema", err)
+	defer schemaRows.Close()
+
+	schema := &Schema{}
+	for schemaRows != nil && schemaRows.Next() {
+		entry := &SchemaEntry{}
+		err = schemaRows.Scan(&entry.objType, &entry.name, &entry.tblName, &entry.sql)
+		failOnErr("step schema", err)
+		switch {
+		case entry.objType == "table" && strings.HasPrefix(entry.name, "sqlite_"):
+			// sqlite_stat* is left out: statistics are rebuilt by ANALYZE
+			if entry.name == "sqlite_sequence" {
+				schema.internal = append(schema.internal, entry)
+			}
+		case entry.objType == "table":
+			schema.tables = append(schema.tables, entry)
+		case entry.objType == "index":
+			schema.indexes = append(schema.indexes, entry)
+		case entry.objType == "trigger":
+			schema.triggers = append(schema.triggers, entry)
+		case entry.objType == "view":
+			schema.views = append(schema.views, entry)
+		}
+	}
+	sort.Slice(schema.tables, func(i, j int) bool { return schema.tables[i].name < schema.tables[j].name })
+	return schema, ctx.Err()
+}
 
-	tableNames := make([]string, 0, 10)
-	for tableRows != nil && tableRows.Next() {
-		var tableName string
-		var tableType string
-		var creationStmt string
-		err = tableRows.Scan(&tableName, &tableType, &creationStmt)
-		failOnErr("step tables", err)
-		tableNames = append(tableNames, tableName)
+func getTableNames(ctx context.Context, db queryer) ([]string, error) {
+	schema, err := getSchema(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	tableNames := make([]string, 0, len(schema.tables))
+	for _, table := range schema.tables {
+		tableNames = append(tableNames, table.name)
 	}
-	return tableNames
+	return tableNames, nil
 }
 
-func getTableInfo(db *sql.DB, tableName string) *TableInfo {
-	stmtTableInfo := "PRAGMA table_info('" + tableName + "')"
-	rs, err := db.Query(stmtTableInfo)
+func getTableInfo(ctx context.Context, db queryer, tableName string) (*TableInfo, error) {
+	stmtTableInfo := "PRAGMA table_info(" + quoteIdent(tableName) + ")"
+	rs, err := db.QueryContext(ctx, stmtTableInfo)
+	if cErr := cancelledErr(ctx, err); cErr != nil {
+		return nil, cErr
+	}
 	failOnErr("table info", err)
 	defer rs.Close()
 
@@ -255,26 +643,131 @@ func getTableInfo(db *sql.DB, tableName string) *TableInfo {
 		err = rs.Scan(&colId, &colName, &colType, &nullable, &defaultVal, &pk)
 		failOnErr("parse table info", err)
 		colInfos = append(colInfos, &ColumnInfo{
-			colName: colName,
-			colType: colType,
+			colName:  colName,
+			colType:  colType,
+			affinity: columnAffinity(colType),
+			pk:       pk,
 		})
 	}
 
-	return &TableInfo{columnInfos: colInfos}
+	return &TableInfo{columnInfos: colInfos}, ctx.Err()
+}
+
+/*
+ * INSERTs with up to iw.maxRows() rows each, values encoded by appendValue - of the rows as filtered and masked by
+ * table, see forEachRow
+ */
+func dumpInsStmts(ctx context.Context, db *sql.DB, table *SchemaEntry, tableInfo *TableInfo, iw *insWriter, progress ProgressFunc) error {
+	tableName := table.name
+	colNames := make([]string, 0, len(tableInfo.columnInfos))
+	for _, ci := range tableInfo.columnInfos {
+		colNames = append(colNames, quoteIdent(ci.colName))
+	}
+	insPrefix := "INSERT INTO " + quoteIdent(tableName) + "(" + strings.Join(colNames, ", ") + ") VALUES"
+
+	maxRows, maxBytes := iw.maxRows(), iw.maxBytes()
+	var stmt strings.Builder
+	var row strings.Builder
+	rowsInStmt := 0
+	flush := func() {
+		if rowsInStmt == 0 {
+			return
+		}
+		stmt.WriteString(";\n")
+		iw.writeStmt(stmt.String())
+		stmt.Reset()
+		rowsInStmt = 0
+	}
+
+	err := forEachRow(ctx, db, table, tableInfo, progress, func(vals []interface{}) error {
+		row.Reset()
+		row.WriteByte('(')
+		for i, v := range vals {
+			if i > 0 {
+				row.WriteString(", ")
+			}
+			appendValue(&row, v, tableInfo.columnInfos[i].affinity)
+		}
+		row.WriteByte(')')
+
+		if rowsInStmt > 0 && (rowsInStmt >= maxRows || stmt.Len()+1+row.Len()+2 > maxBytes) {
+			flush()
+		}
+		if rowsInStmt == 0 {
+			stmt.WriteString(insPrefix)
+		} else {
+			stmt.WriteByte(',')
+		}
+		stmt.WriteString(row.String())
+		rowsInStmt++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	flush()
+	return nil
 }
 
-func dumpInsStmts(db *sql.DB, stmtInsStmts string, file io.Writer) {
-	insRows, err := db.Query(stmtInsStmts)
+/*
+ * calls exec with the raw values (see rawColumnList) of each row of a table matching its predicate, masked by its
+ * masker (see DumpFilter resp. Masking) - vals is reused from row to row. reports the dump progress of the table.
+ */
+func forEachRow(ctx context.Context, db *sql.DB, table *SchemaEntry, tableInfo *TableInfo, progress ProgressFunc, exec func(vals []interface{}) error) error {
+	tableName := table.name
+	query := "SELECT " + rawColumnList(tableInfo) + " FROM " + quoteIdent(tableName)
+	if table.where != "" {
+		query += " WHERE (" + table.where + ")"
+	}
+	dataRows, err := db.QueryContext(ctx, query)
+	if cErr := cancelledErr(ctx, err); cErr != nil {
+		return cErr
+	}
 	failOnErr("query table content", err)
-	defer insRows.Close()
+	defer dataRows.Close()
 
-	for insRows != nil && insRows.Next() {
-		var insStmt string
-		err = insRows.Scan(&insStmt)
-		failOnErr("step insStmts", err)
+	vals := make([]interface{}, len(tableInfo.columnInfos))
+	ptrs := make([]interface{}, len(vals))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	var rows int64
+	for dataRows != nil && dataRows.Next() {
+		err = dataRows.Scan(ptrs...)
+		failOnErr("step table content", err)
+		table.masker.mask(vals)
 
-		_, err = file.Write([]byte(insStmt + ";\n"))
-		failOnErr("write insStmts", err)
+		err = exec(vals)
+		if err != nil {
+			return err
+		}
+
+		rows++
+		if rows%progressDumpRowStep == 0 {
+			progress.report(Progress{Phase: ProgressDump, Table: tableName, Rows: rows})
+		}
+	}
+	// a cancelled query simply ends the iteration - as does a row failing to be read, e.g. a predicate's function
+	// failing on its value
+	if cErr := cancelledErr(ctx, dataRows.Err()); cErr != nil {
+		return cErr
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	if err = dataRows.Err(); err != nil {
+		return errors.Because(err, err, fmt.Sprintf("reading rows of table %s", tableName))
 	}
+	progress.report(Progress{Phase: ProgressDump, Table: tableName, Rows: rows, Done: true})
+	return nil
+}
 
+/*
+ * a query failing because of a cancelled/expired ctx is not fatal => the ctx error is returned instead
+ */
+func cancelledErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return nil
 }
@@ -108,7 +108,7 @@ func FillInDummyData() {
 func failOnErr(msg string, err error) {
 	if err != nil {
 		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf(msg+": %+v", err) + "\n")
-		os.Exit(1)
+		Exit(1)
 	}
 }
 
@@ -0,0 +1,1135 @@
+package database
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+/*
+ * dump/restore round trips on a small db with the real schema (createSchema) - runs in seconds, no child process
+ */
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "oom-dump-test-")
+	if err != nil {
+		panic(err)
+	}
+	_, err = InitTempSpace(dir)
+	if err != nil {
+		panic(err)
+	}
+	InitDB()
+	fillEdgeCaseData(MyDb)
+
+	code := m.Run()
+
+	_ = MyDb.Close()
+	CleanupTempSpace()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+var edgeCaseTexts = []interface{}{
+	nil,
+	"",
+	"it's",
+	`"double" 'single'' quotes`,
+	"line1\nline2\r\nline3",
+	"semi;colon -- no comment /* nor this */ END;",
+	"unicode: äöü ß € 日本語 🚀 é ‮right-to-left",
+	"nul\x00byte",
+	[]byte{0x00, 0x01, 0xfe, 0xff}, // a blob in a text column - TEXT affinity keeps it a blob
+	"    leading and trailing spaces    ",
+	"12345", // numeric looking text
+}
+
+var edgeCaseReals = []interface{}{
+	nil,
+	0.0,
+	2.0,
+	0.1,
+	1.0 / 3,
+	-1.5e-7,
+	math.MaxFloat64,
+	-math.MaxFloat64,
+	math.SmallestNonzeroFloat64,
+	math.Inf(1),
+	math.Inf(-1),
+	0.743172823131311, // not parsed back exactly by sqlite from its shortest representation
+}
+
+func edgeCaseId(i int) string {
+	return fmt.Sprintf("%08d-0000-4000-8000-%012d", i, i)
+}
+
+func mustExec(db *sql.DB, stmt string, args ...interface{}) {
+	_, err := db.Exec(stmt, args...)
+	if err != nil {
+		panic(fmt.Sprintf("%s: %v", stmt, err))
+	}
+}
+
+func fillEdgeCaseData(db *sql.DB) {
+	for i, text := range edgeCaseTexts {
+		realVal := edgeCaseReals[i%len(edgeCaseReals)]
+		id := edgeCaseId(i)
+		mustExec(db, "insert into t1 (id, t1f1, t1f2) values (?, ?, ?)", id, text, i%2)
+		mustExec(db, "insert into t2 (id, t2f1, t2f2) values (?, ?, ?)", id, fmt.Sprintf("%v", text), fmt.Sprintf("pk-%d", i))
+		mustExec(db, "insert into t3 (id, t3f1, t3f2, t3f3, t3f4, t3f5, t3f8) values (?, ?, ?, ?, ?, ?, ?)",
+			id, text, text, nil, []interface{}{nil, int64(math.MaxInt64), int64(math.MinInt64), 0}[i%4], realVal, text)
+		mustExec(db, "insert into t5 (id, t1_id, t5f1, t5f2, t5f3, t5f4) values (?, ?, ?, ?, ?, ?)",
+			id, id, i%2, "2022-02-22", text, []string{"valA", "valB", "valC"}[i%3])
+		mustExec(db, "insert into t10 (id, t10f1, t10f2) values (?, ?, ?)", id, fmt.Sprintf("%d:%v", i, text), "x")
+	}
+	for i, realVal := range edgeCaseReals {
+		id := edgeCaseId(i % len(edgeCaseTexts))
+		day := fmt.Sprintf("2022-01-%02d", i+1)
+		mustExec(db, "insert into t6 (t5_id, t6f1, t6f2) values (?, ?, ?)", id, day, realVal)
+		if realVal != nil {
+			mustExec(db, "insert into t11 (t10_id, t11f1, t11f2) values (?, ?, ?)", id, day, realVal)
+		}
+	}
+}
+
+func TestDumpRestoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	sourceDigests, err := digestTables(ctx, MyDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceSchema := schemaSql(t, MyDb)
+
+	for _, strategy := range SnapshotStrategies() {
+		for _, copyMethod := range copyMethods {
+			strategy, copyMethod := strategy, copyMethod
+			t.Run(strategy.Name()+"/"+string(copyMethod), func(t *testing.T) {
+				opts := DefaultActivityOptions()
+				opts.Strategy = strategy
+				opts.CopyMethod = copyMethod
+				res, err := Activity(ctx, ActivityDump, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				dump := readDumpFile(t, res.DumpFile)
+
+				restored := openFreshDb(t)
+				restoreRes, err := Restore(ctx, restored, bytes.NewReader(dump), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if restoreRes.ForeignKeyViolations != 0 {
+					t.Errorf("%d foreign key violations after restore", restoreRes.ForeignKeyViolations)
+				}
+
+				restoredDigests, err := digestTables(ctx, restored)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, tv := range compareDigests(sourceDigests, restoredDigests) {
+					if !tv.Matches() {
+						t.Errorf("table %s differs: rows %d/%d, hash %.12s/%.12s (source/restored)",
+							tv.Table, tv.SourceRows, tv.SnapshotRows, tv.SourceHash, tv.SnapshotHash)
+					}
+				}
+				if restoredSchema := schemaSql(t, restored); restoredSchema != sourceSchema {
+					t.Errorf("schema differs:\n%s\nvs. restored:\n%s", sourceSchema, restoredSchema)
+				}
+
+				// a dump of the restored db is the very same
+				var redump bytes.Buffer
+				err = alternativeDump(ctx, restored, nil, &redump, SqlDumpOptions{}, nil, nil, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(dump, redump.Bytes()) {
+					t.Errorf("dump of restored db differs from original dump")
+				}
+			})
+		}
+	}
+}
+
+/*
+ * views come before the triggers, an INSTEAD OF trigger is created on one - the data goes in without firing triggers
+ */
+func TestDumpViewsAndTriggers(t *testing.T) {
+	ctx := context.Background()
+	db := openFreshDb(t)
+	mustExec(db, "CREATE TABLE item (id INTEGER PRIMARY KEY, name TEXT)")
+	mustExec(db, "CREATE TABLE log (msg TEXT)")
+	mustExec(db, "CREATE VIEW item_names AS SELECT name FROM item")
+	mustExec(db, "CREATE VIEW item_count AS SELECT count(*) AS n FROM item_names")
+	mustExec(db, "CREATE TRIGGER item_names_ins INSTEAD OF INSERT ON item_names BEGIN INSERT INTO item (name) VALUES (new.name); END")
+	mustExec(db, "CREATE TRIGGER item_log AFTER INSERT ON item BEGIN INSERT INTO log VALUES ('inserted ' || new.name); END")
+	mustExec(db, "INSERT INTO item_names VALUES ('a'), ('b')")
+
+	var dump bytes.Buffer
+	err := alternativeDump(ctx, db, nil, &dump, SqlDumpOptions{}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := openFreshDb(t)
+	_, err = Restore(ctx, restored, bytes.NewReader(dump.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restoredSchema, schema := schemaSql(t, restored), schemaSql(t, db); restoredSchema != schema {
+		t.Errorf("schema differs:\n%s\nvs. restored:\n%s", schema, restoredSchema)
+	}
+	mustExec(restored, "INSERT INTO item_names VALUES ('c')")
+	got, err := queryStrings(ctx, restored, "SELECT msg FROM log UNION ALL SELECT n FROM item_count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "inserted a,inserted b,inserted c,3"; strings.Join(got, ",") != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+}
+
+func TestBatchedSqlDump(t *testing.T) {
+	ctx := context.Background()
+	sourceDigests, err := digestTables(ctx, MyDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultActivityOptions()
+	opts.SqlDump = SqlDumpOptions{RowsPerInsert: 4, MaxInsertBytes: 400, CommitEvery: 3}
+	res, err := Activity(ctx, ActivityDump, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := readDumpFile(t, res.DumpFile)
+	if !bytes.Contains(dump, []byte("),(")) || !bytes.Contains(dump, []byte("COMMIT;\nBEGIN TRANSACTION;\n")) {
+		t.Errorf("no multi-row INSERTs or intermediate COMMITs in dump")
+	}
+	for _, line := range strings.Split(string(dump), ";\n") {
+		if strings.HasPrefix(line, "INSERT") && strings.Count(line, "),(") >= 4 {
+			t.Errorf("more than 4 rows in %s", line)
+		}
+	}
+
+	restored := openFreshDb(t)
+	_, err = Restore(ctx, restored, bytes.NewReader(dump), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoredDigests, err := digestTables(ctx, restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tv := range compareDigests(sourceDigests, restoredDigests) {
+		if !tv.Matches() {
+			t.Errorf("table %s differs", tv.Table)
+		}
+	}
+}
+
+func TestParallelSqlDump(t *testing.T) {
+	ctx := context.Background()
+	seqRes, err := Activity(ctx, ActivityDump, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := readDumpFile(t, seqRes.DumpFile)
+
+	for _, tc := range []struct {
+		strategy    SnapshotStrategy
+		copyMethod  SnapshotCopyMethod
+		wantWorkers int
+	}{
+		{StrategyTempFile, CopyBackup, 3},
+		{StrategyPrivateMemory, CopyVacuumInto, 3},
+		{StrategyPrivateMemory, CopyBackup, 1},            // private to the snapshot connection
+		{StrategyTempFile, CopySerializeSqliteManaged, 1}, // the image lives in the snapshot connection only
+	} {
+		opts := DefaultActivityOptions()
+		opts.Strategy, opts.CopyMethod, opts.DumpWorkers = tc.strategy, tc.copyMethod, 3
+		res, err := Activity(ctx, ActivityDump, opts)
+		if err != nil {
+			t.Fatalf("%s/%s: %v", tc.strategy.Name(), tc.copyMethod, err)
+		}
+		if res.DumpWorkers != tc.wantWorkers {
+			t.Errorf("%s/%s: dumped by %d workers, want %d", tc.strategy.Name(), tc.copyMethod, res.DumpWorkers, tc.wantWorkers)
+		}
+		if !bytes.Equal(readDumpFile(t, res.DumpFile), want) {
+			t.Errorf("%s/%s: parallel dump differs from sequential one", tc.strategy.Name(), tc.copyMethod)
+		}
+	}
+}
+
+/*
+ * intermediate COMMITs are placed across tables, sqlite_sequence is preceded by a DELETE - both while merging the parts
+ */
+func TestParallelSqlDumpParts(t *testing.T) {
+	ctx := context.Background()
+	dbFile := filepath.Join(t.TempDir(), "parts.db")
+	db, err := sql.Open("sqlite3", "file:"+dbFile+"?mode=rwc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mustExec(db, "CREATE TABLE a (id INTEGER PRIMARY KEY AUTOINCREMENT, v TEXT)")
+	mustExec(db, "CREATE TABLE b (id INTEGER PRIMARY KEY AUTOINCREMENT, v REAL)")
+	mustExec(db, "CREATE TABLE c (v BLOB)")
+	for i := 0; i < 50; i++ {
+		mustExec(db, "INSERT INTO a(v) VALUES (?)", fmt.Sprintf("a;\n%d", i))
+		if i%3 == 0 {
+			mustExec(db, "INSERT INTO b(v) VALUES (?)", float64(i)/7)
+		}
+	}
+	mustExec(db, "INSERT INTO c VALUES (x'00ff')")
+
+	readers, err := sql.Open("sqlite3", "file:"+dbFile+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readers.Close()
+	readers.SetMaxOpenConns(2)
+
+	for _, sqlOpts := range []SqlDumpOptions{{}, {CommitEvery: 7}, {RowsPerInsert: 4, CommitEvery: 2}, {RowsPerInsert: 100, CommitEvery: 1}} {
+		var seq, par bytes.Buffer
+		err = alternativeDump(ctx, db, nil, &seq, sqlOpts, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = alternativeDump(ctx, db, readers, &par, sqlOpts, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(seq.Bytes(), []byte("DELETE FROM \"sqlite_sequence\";\n")) {
+			t.Fatal("no sqlite_sequence in dump")
+		}
+		if seq.String() != par.String() {
+			t.Errorf("%+v: parallel dump differs from sequential one:\n%s\n---\n%s", sqlOpts, par.String(), seq.String())
+		}
+	}
+}
+
+/*
+ * a full dump followed by incrementals restores to the db as of the last one - deletes, updates and inserts, composite
+ * primary keys out of column order, tables without primary key or with NULL keys and sqlite_sequence included
+ */
+func TestDumpChain(t *testing.T) {
+	ctx := context.Background()
+	dbFile := filepath.Join(t.TempDir(), "chain.db")
+	db, err := sql.Open("sqlite3", "file:"+dbFile+"?mode=rwc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mustExec(db, "CREATE TABLE a (id INTEGER PRIMARY KEY AUTOINCREMENT, v TEXT)")
+	mustExec(db, "CREATE TABLE b (k1 TEXT, k2 INTEGER, v REAL, PRIMARY KEY (k2, k1))")
+	mustExec(db, "CREATE TABLE c (v BLOB)")
+	mustExec(db, "CREATE TABLE d (k TEXT PRIMARY KEY)")
+	mustExec(db, "CREATE TABLE e (k TEXT PRIMARY KEY, v INTEGER)")
+	for i := 0; i < 20; i++ {
+		mustExec(db, "INSERT INTO a(v) VALUES (?)", fmt.Sprintf("it's;\n%d", i))
+		mustExec(db, "INSERT INTO b VALUES (?, ?, ?)", fmt.Sprintf("k%d", i%3), i, float64(i)/7)
+	}
+	mustExec(db, "INSERT INTO c VALUES (x'00ff')")
+	mustExec(db, "INSERT INTO d VALUES ('x'), ('y')")
+	mustExec(db, "INSERT INTO e VALUES ('k', 1), (NULL, 2), (NULL, 3)")
+
+	chain := NewDumpChain()
+	opts := DefaultActivityOptions()
+	opts.Codec = CodecNone
+	dump := func() *ChainDump {
+		res := &ActivityResult{}
+		err := chain.dump(ctx, db, nil, opts, res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.ChainDump
+	}
+	if d := dump(); d.Kind != ChainDumpFull {
+		t.Errorf("first dump of chain is %s", d)
+	}
+
+	mustExec(db, "DELETE FROM a WHERE id IN (3, 20)")
+	mustExec(db, "UPDATE a SET v = NULL WHERE id = 5")
+	mustExec(db, "INSERT INTO a(v) VALUES ('new')")
+	mustExec(db, "UPDATE b SET v = -v WHERE k2 = 7")
+	mustExec(db, "INSERT INTO c VALUES (NULL)")
+	mustExec(db, "DELETE FROM d WHERE k = 'x'")
+	mustExec(db, "INSERT INTO d VALUES ('z')")
+	mustExec(db, "UPDATE e SET v = -v WHERE k IS NULL")
+	want := ChainDump{Seq: 1, Kind: ChainDumpIncremental, Inserts: 2, Updates: 2, Deletes: 3} // c, e and sqlite_sequence replaced as a whole
+	if d := dump(); d.Seq != want.Seq || d.Kind != want.Kind || d.Inserts != want.Inserts || d.Updates != want.Updates || d.Deletes != want.Deletes {
+		t.Errorf("got %s, want %s", d, &want)
+	}
+	if d := dump(); d.Inserts+d.Updates+d.Deletes != 0 {
+		t.Errorf("unchanged db gave %s", d)
+	}
+	mustExec(db, "UPDATE e SET k = 'n' || v WHERE k IS NULL") // keyed by row again
+	if d := dump(); d.Inserts+d.Updates+d.Deletes != 0 {
+		t.Errorf("e keyed by row again gave %s", d)
+	}
+	mustExec(db, "UPDATE e SET v = 0 WHERE k = 'k'")
+	if d := dump(); d.Updates != 1 || d.Inserts+d.Deletes != 0 {
+		t.Errorf("update of e gave %s", d)
+	}
+
+	manifestFile := filepath.Join(TempDir(), "chain-"+chain.manifest.Chain+ChainManifestSuffix)
+	manifest, err := readChainManifest(manifestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Dumps) != 5 {
+		t.Errorf("%d dumps in manifest, want 5", len(manifest.Dumps))
+	}
+	states, _ := filepath.Glob(filepath.Join(TempDir(), "chain-"+manifest.Chain+"-*.state.db"))
+	if len(states) != 1 || filepath.Base(states[0]) != manifest.State {
+		t.Errorf("chain states %v, want %s only", states, manifest.State)
+	}
+
+	restored := openFreshDb(t)
+	_, err = RestoreChain(ctx, restored, manifestFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceDigests, err := digestTables(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoredDigests, err := digestTables(ctx, restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tv := range compareDigests(sourceDigests, restoredDigests) {
+		if !tv.Matches() {
+			t.Errorf("table %s differs: rows %d/%d (source/restored)", tv.Table, tv.SourceRows, tv.SnapshotRows)
+		}
+	}
+
+	// a changed schema starts over
+	mustExec(db, "CREATE INDEX b_v ON b(v)")
+	if d := dump(); d.Kind != ChainDumpFull || chain.manifest.Chain == manifest.Chain {
+		t.Errorf("dump after schema change is %s of chain %s", d, chain.manifest.Chain)
+	}
+}
+
+/*
+ * replaying an incremental dump does not fire the triggers restored by the full one - their effects are part of the
+ * dump already
+ */
+func TestDumpChainTriggers(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "triggers.db")+"?mode=rwc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mustExec(db, "CREATE TABLE item (id INTEGER PRIMARY KEY, v TEXT)")
+	// dumped ahead of item, so a trigger fired by restoring item's changes would add to it
+	mustExec(db, "CREATE TABLE audit (id INTEGER PRIMARY KEY, msg TEXT)")
+	mustExec(db, "CREATE TRIGGER item_ins AFTER INSERT ON item BEGIN INSERT INTO audit(msg) VALUES ('ins ' || new.id); END")
+	mustExec(db, "CREATE TRIGGER item_upd AFTER UPDATE ON item BEGIN INSERT INTO audit(msg) VALUES ('upd ' || new.id); END")
+	mustExec(db, "CREATE TRIGGER item_del AFTER DELETE ON item BEGIN INSERT INTO audit(msg) VALUES ('del ' || old.id); END")
+	for i := 0; i < 5; i++ {
+		mustExec(db, "INSERT INTO item(v) VALUES (?)", fmt.Sprintf("v%d", i))
+	}
+
+	chain := NewDumpChain()
+	opts := DefaultActivityOptions()
+	opts.Codec = CodecNone
+	for _, change := range []string{"", "UPDATE item SET v = 'changed' WHERE id = 2", "DELETE FROM item WHERE id = 4",
+		"INSERT INTO item(v) VALUES ('new')"} {
+		if change != "" {
+			mustExec(db, change)
+		}
+		err = chain.dump(ctx, db, nil, opts, &ActivityResult{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restored := openFreshDb(t)
+	_, err = RestoreChain(ctx, restored, chainManifestFile(chain.manifest.Chain), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{"SELECT id || ' ' || msg FROM audit ORDER BY id", "SELECT id || ' ' || v FROM item ORDER BY id",
+		"SELECT name FROM sqlite_master WHERE type = 'trigger' ORDER BY name"} {
+		want, err := queryStrings(ctx, db, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := queryStrings(ctx, restored, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: restored\n%s\nwant\n%s", query, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+/*
+ * include/exclude patterns pick the tables, a predicate the rows of t6 - a filter not fitting the snapshot fails the
+ * dump before it starts
+ */
+func TestDumpFilter(t *testing.T) {
+	ctx := context.Background()
+	sourceDigests, err := digestTables(ctx, MyDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wantT6Rows int
+	err = MyDb.QueryRow("SELECT count(*) FROM t6 WHERE t6f1 >= '2022-01-05'").Scan(&wantT6Rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultActivityOptions()
+	opts.Filter = &DumpFilter{Include: []string{"T6", "t1*"}, Exclude: []string{"t11"}, Where: map[string]string{"t6": "t6f1 >= '2022-01-05'"}}
+	res, err := Activity(ctx, ActivityDump, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := openFreshDb(t)
+	_, err = Restore(ctx, restored, bytes.NewReader(readDumpFile(t, res.DumpFile)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables, err := getTableNames(ctx, restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tables, ",") != "t1,t10,t6" {
+		t.Errorf("dumped tables %v, want t1, t10, t6", tables)
+	}
+	restoredDigests, err := digestTables(ctx, restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tv := range compareDigests(sourceDigests, restoredDigests) {
+		switch tv.Table {
+		case "t1", "t10":
+			if !tv.Matches() {
+				t.Errorf("table %s differs", tv.Table)
+			}
+		case "t6":
+			if tv.SnapshotRows != int64(wantT6Rows) || wantT6Rows == 0 || tv.SourceRows == int64(wantT6Rows) {
+				t.Errorf("%d rows of t6 dumped, want %d of %d", tv.SnapshotRows, wantT6Rows, tv.SourceRows)
+			}
+		}
+	}
+
+	for _, filter := range []*DumpFilter{
+		{Include: []string{"t["}},
+		{Where: map[string]string{"t6": "nosuch = 1"}},
+		{Where: map[string]string{"t11": "1"}, Exclude: []string{"t11"}},
+		{Where: map[string]string{"t6": "1); DELETE FROM t6; SELECT (1"}},
+		{Where: map[string]string{"t6": "1) OR (1"}},
+		{Where: map[string]string{"t6": "1 -- "}},
+		{Where: map[string]string{"t6": " "}},
+		{Where: map[string]string{"t6": "1", "T6": "0"}},
+		{Where: map[string]string{"t6": "json('x' || t6f1) IS NOT NULL"}}, // fails on reading the rows only
+	} {
+		_, err = getDumpSchema(ctx, MyDb, filter, nil)
+		if _, ok := err.(*DumpFilterError); !ok {
+			t.Errorf("%s: got %v, want a *DumpFilterError", filter, err)
+		}
+	}
+	_, err = getDumpSchema(ctx, MyDb, &DumpFilter{Where: map[string]string{"t6": "t6f1 IN (')', '(', ';', '--')"}}, nil)
+	if err != nil {
+		t.Errorf("quoted special chars rejected: %v", err)
+	}
+	opts.Filter = &DumpFilter{Where: map[string]string{"t6": "nosuch = 1"}}
+	res, err = Activity(ctx, ActivityDump, opts)
+	if _, ok := err.(*DumpFilterError); !ok || res.DumpFile != "" {
+		t.Errorf("got %v and dump %q, want a *DumpFilterError and no dump", err, res.DumpFile)
+	}
+	// nothing streamed yet, so a http response can still tell
+	var streamed bytes.Buffer
+	_, err = StreamDump(ctx, &streamed, opts)
+	if _, ok := err.(*DumpFilterError); !ok || streamed.Len() != 0 {
+		t.Errorf("got %v and %d bytes streamed, want a *DumpFilterError and none", err, streamed.Len())
+	}
+}
+
+/*
+ * an activity cancelled while snapshotting resp. dumping stops between two backup steps resp. two tables and leaves
+ * neither the temp snapshot file nor the partial dump behind
+ */
+func TestActivityCancelled(t *testing.T) {
+	before, err := filepath.Glob(filepath.Join(TempDir(), "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, phase := range []string{ProgressSnapshot, ProgressDump} {
+		ctx, cancel := context.WithCancel(context.Background())
+		var events []Progress
+		opts := DefaultActivityOptions()
+		opts.Strategy = StrategyTempFile
+		opts.Stepping = StepPolicy{Pages: 1}
+		opts.Progress = func(p Progress) {
+			events = append(events, p)
+			if p.Phase == phase {
+				cancel()
+			}
+		}
+		res, err := Activity(ctx, ActivityDump, opts)
+		cancel()
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: got %v, want context.Canceled", phase, err)
+		}
+		if res.DumpFile != "" {
+			t.Errorf("%s: dump %s written", phase, res.DumpFile)
+		}
+		var cancelledAt []Progress // the events after the one cancelling - neither of its phase nor of the dump
+		for i, p := range events {
+			if p.Phase == phase {
+				cancelledAt = events[i+1:]
+				break
+			}
+		}
+		for _, p := range cancelledAt {
+			if p.Phase == ProgressDump || p.Phase == phase {
+				t.Errorf("%s: %s after cancel", phase, p)
+			}
+		}
+		after, err := filepath.Glob(filepath.Join(TempDir(), "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(after, before) {
+			t.Errorf("%s: temp dir holds %v, want %v", phase, after, before)
+		}
+	}
+}
+
+/*
+ * a row failing to be read fails the dump of its table - it does not just end it, as if the table was done
+ */
+func TestDumpRowReadError(t *testing.T) {
+	ctx := context.Background()
+	table := &SchemaEntry{objType: "table", name: "t6", tblName: "t6", where: "json('x' || t6f1) IS NOT NULL"} // malformed json
+	var events []Progress
+	var buf bytes.Buffer
+	err := dumpTableData(ctx, MyDb, table, &insWriter{file: &buf}, func(p Progress) { events = append(events, p) })
+	if err == nil {
+		t.Errorf("dump succeeded with %d bytes", buf.Len())
+	}
+	for _, p := range events {
+		if p.Done {
+			t.Errorf("failed table reported as %s", p)
+		}
+	}
+
+	// nor does it make the rows of a chain state vanish
+	err = buildChainState(ctx, MyDb, &Schema{tables: []*SchemaEntry{table}}, filepath.Join(t.TempDir(), "state.db"))
+	if err == nil {
+		t.Errorf("chain state built")
+	}
+}
+
+/*
+ * ids faked alike in all tables still satisfy their CHECKs and foreign keys, masked columns keep nothing of the source
+ * - incremental dumps delete rows by their masked keys
+ */
+func TestMasking(t *testing.T) {
+	ctx := context.Background()
+	masking := &Masking{Salt: "s"}
+	for _, r := range [][3]string{{"t1", "id", "fake"}, {"t2", "id", "fake"}, {"t3", "id", "fake"}, {"t5", "t1_id", "fake"},
+		{"t1", "t1f1", "hash"}, {"t3", "t3f1", "redact"}, {"T3", "T3F2", "TRUNCATE-3"}} {
+		rule, err := NewMaskRule(r[0], r[1], r[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		masking.Rules = append(masking.Rules, rule)
+	}
+	opts := DefaultActivityOptions()
+	opts.Masking = masking
+	res, err := Activity(ctx, ActivityDump, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := openFreshDb(t)
+	_, err = Restore(ctx, restored, bytes.NewReader(readDumpFile(t, res.DumpFile)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, check := range []struct{ what, query string }{
+		{"t2 rows not joining t1", "SELECT count(*) FROM t2 WHERE id NOT IN (SELECT id FROM t1)"},
+		{"t5 rows not joining t1", "SELECT count(*) FROM t5 WHERE t1_id NOT IN (SELECT id FROM t1)"},
+		{"t1f1 not hashed", "SELECT count(*) FROM t1 WHERE t1f1 NOT NULL AND NOT (length(t1f1) = 64 OR typeof(t1f1) = 'blob' AND length(t1f1) = 32)"},
+		{"t3f1 not redacted", "SELECT count(*) FROM t3 WHERE t3f1 NOT IN ('REDACTED', x'')"},
+		{"t3f2 not truncated", "SELECT count(*) FROM t3 WHERE length(t3f2) > 3"},
+	} {
+		var n int
+		err = restored.QueryRow(check.query).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("%s: %d rows", check.what, n)
+		}
+	}
+	sourceIds, err := queryStrings(ctx, MyDb, "SELECT id FROM t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	maskedIds, err := queryStrings(ctx, restored, "SELECT id FROM t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := make(map[string]bool)
+	for _, id := range maskedIds {
+		kept[id] = true
+	}
+	for _, id := range sourceIds {
+		if kept[id] {
+			t.Errorf("id %s not masked", id)
+		}
+	}
+	if len(kept) != len(sourceIds) {
+		t.Errorf("%d distinct masked ids of %d", len(kept), len(sourceIds))
+	}
+
+	for _, method := range []string{"truncate", "hash-3", "truncate-x", "nosuch"} {
+		if _, err := NewMaskRule("t1", "t1f1", method); err == nil {
+			t.Errorf("mask method %q accepted", method)
+		}
+	}
+	for _, m := range []*Masking{
+		{Salt: "s", Rules: []MaskRule{{Table: "t1", Column: "nosuch", Method: MaskRedact}}},
+		{Salt: "s", Rules: []MaskRule{{Table: "nosuch", Column: "id", Method: MaskRedact}}},
+		{Rules: []MaskRule{{Table: "t1", Column: "t1f1", Method: MaskHash}}},
+		// values of a key would collide
+		{Salt: "s", Rules: []MaskRule{{Table: "t1", Column: "id", Method: MaskTruncate, Length: 8}}},
+		{Salt: "s", Rules: []MaskRule{{Table: "t6", Column: "t6f1", Method: MaskRedact}}},
+		{Salt: "s", Rules: []MaskRule{{Table: "t10", Column: "t10f2", Method: MaskTruncate, Length: 1}}},
+	} {
+		_, err = getDumpSchema(ctx, MyDb, nil, m)
+		if _, ok := err.(*MaskingError); !ok {
+			t.Errorf("%s: got %v, want a *MaskingError", m, err)
+		}
+	}
+
+	// deletes and updates of an incremental dump find the rows by their masked keys
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "masked.db")+"?mode=rwc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mustExec(db, "CREATE TABLE p (id TEXT PRIMARY KEY, v TEXT)")
+	for i := 0; i < 10; i++ {
+		mustExec(db, "INSERT INTO p VALUES (?, ?)", fmt.Sprintf("id-%d", i), fmt.Sprintf("v%d", i))
+	}
+	opts = DefaultActivityOptions()
+	opts.Codec = CodecNone
+	opts.Masking = &Masking{Salt: "s", Rules: []MaskRule{{Table: "p", Column: "id", Method: MaskFake}, {Table: "p", Column: "v", Method: MaskHash}}}
+	chain := NewDumpChain()
+	for _, change := range []string{"", "DELETE FROM p WHERE id IN ('id-1', 'id-2')", "UPDATE p SET v = 'changed' WHERE id = 'id-3'"} {
+		if change != "" {
+			mustExec(db, change)
+		}
+		err = chain.dump(ctx, db, nil, opts, &ActivityResult{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	restored = openFreshDb(t)
+	_, err = RestoreChain(ctx, restored, filepath.Join(TempDir(), "chain-"+chain.manifest.Chain+ChainManifestSuffix), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := queryStrings(ctx, db, "SELECT id || '=' || v FROM p ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, row := range want {
+		eq := strings.IndexByte(row, '=')
+		vals := []interface{}{row[:eq], row[eq+1:]}
+		(&rowMasker{salt: []byte("s"), rules: map[int]MaskRule{0: opts.Masking.Rules[0], 1: opts.Masking.Rules[1]}}).mask(vals)
+		want[i] = fmt.Sprintf("%s=%s", vals[0], vals[1])
+	}
+	got, err := queryStrings(ctx, restored, "SELECT id || '=' || v FROM p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(want)
+	sort.Strings(got)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("restored chain\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+/*
+ * a dump of the generated schema with every key column faked restores all rows - masked ids still unique, joining and
+ * matching their CHECKs
+ */
+func TestMaskedRestore(t *testing.T) {
+	ctx := context.Background()
+	masking := &Masking{Salt: "s"}
+	for _, col := range []string{"t1.id", "t2.id", "t2.t2f2", "t3.id", "t5.id", "t5.t1_id", "t6.t5_id", "t6.t6f1",
+		"t10.id", "t10.t10f1", "t11.t10_id", "t11.t11f1"} {
+		dot := strings.IndexByte(col, '.')
+		masking.Rules = append(masking.Rules, MaskRule{Table: col[:dot], Column: col[dot+1:], Method: MaskFake})
+	}
+	opts := DefaultActivityOptions()
+	opts.Masking = masking
+	res, err := Activity(ctx, ActivityDump, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := openFreshDb(t)
+	restoreRes, err := Restore(ctx, restored, bytes.NewReader(readDumpFile(t, res.DumpFile)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restoreRes.ForeignKeyViolations != 0 {
+		t.Errorf("%d foreign key violations", restoreRes.ForeignKeyViolations)
+	}
+	sourceDigests, err := digestTables(ctx, MyDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoredDigests, err := digestTables(ctx, restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tv := range compareDigests(sourceDigests, restoredDigests) {
+		if tv.MissingInOther || tv.SourceRows != tv.SnapshotRows {
+			t.Errorf("table %s: rows %d/%d (source/restored)", tv.Table, tv.SourceRows, tv.SnapshotRows)
+		}
+	}
+}
+
+func TestCsvDump(t *testing.T) {
+	ctx := context.Background()
+	digests, err := digestTables(ctx, MyDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultActivityOptions()
+	opts.Format = FormatCsv
+	res, err := Activity(ctx, ActivityDump, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(res.DumpFile, ".csv.tar.gz") {
+		t.Errorf("unexpected dump file name %s", res.DumpFile)
+	}
+
+	files := make(map[string][]byte)
+	names := make([]string, 0)
+	tr := tar.NewReader(bytes.NewReader(readDumpFile(t, res.DumpFile)))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = content
+		names = append(names, hdr.Name)
+	}
+	if len(names) == 0 || names[0] != csvManifestName {
+		t.Fatalf("manifest is not the first entry: %v", names)
+	}
+	var manifest CsvManifest
+	err = json.Unmarshal(files[csvManifestName], &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Codec != DefaultCodec.Name() {
+		t.Errorf("got codec %q in manifest, want %q", manifest.Codec, DefaultCodec.Name())
+	}
+	if len(manifest.Tables) != len(digests) {
+		t.Fatalf("got %d tables in manifest, want %d", len(manifest.Tables), len(digests))
+	}
+
+	for i, table := range manifest.Tables {
+		if table.Table != digests[i].Table || table.Rows != digests[i].Rows {
+			t.Errorf("manifest entry %s with %d rows, want %s with %d", table.Table, table.Rows, digests[i].Table, digests[i].Rows)
+		}
+		content := files[table.File]
+		sum := sha256.Sum256(content)
+		if hex.EncodeToString(sum[:]) != table.Sha256 || int64(len(content)) != table.Bytes {
+			t.Errorf("%s: size/checksum differ from manifest", table.File)
+		}
+		records, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+		if err != nil {
+			t.Fatalf("%s: %v", table.File, err)
+		}
+		if int64(len(records)) != table.Rows+1 || len(records[0]) != len(table.Columns) || records[0][0] != table.Columns[0].Name {
+			t.Errorf("%s: unexpected header or number of records", table.File)
+		}
+	}
+
+	// NULL and empty text differ, a blob is hex
+	t1 := string(files["t1.csv"])
+	for _, want := range []string{
+		"\r\n\"" + edgeCaseId(0) + "\",,",
+		"\r\n\"" + edgeCaseId(1) + "\",\"\",",
+		"\r\n\"" + edgeCaseId(8) + "\",0x0001FEFF,",
+	} {
+		if !strings.Contains(t1, want) {
+			t.Errorf("t1.csv does not contain %q", want)
+		}
+	}
+}
+
+func TestJsonlDump(t *testing.T) {
+	ctx := context.Background()
+	digests, err := digestTables(ctx, MyDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultActivityOptions()
+	opts.Format = FormatJsonl
+	res, err := Activity(ctx, ActivityDump, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type jsonlRow struct {
+		Table string                     `json:"table"`
+		Row   map[string]json.RawMessage `json:"row"`
+	}
+	rowsPerTable := make(map[string]int64)
+	t1Rows := make(map[string]map[string]json.RawMessage)
+	scanner := bufio.NewScanner(bytes.NewReader(readDumpFile(t, res.DumpFile)))
+	for scanner.Scan() {
+		var row jsonlRow
+		err = json.Unmarshal(scanner.Bytes(), &row)
+		if err != nil {
+			t.Fatalf("invalid line %s: %v", scanner.Text(), err)
+		}
+		rowsPerTable[row.Table]++
+		if row.Table == "t1" {
+			var id string
+			_ = json.Unmarshal(row.Row["id"], &id)
+			t1Rows[id] = row.Row
+		}
+	}
+	for _, d := range digests {
+		if rowsPerTable[d.Table] != d.Rows {
+			t.Errorf("table %s: got %d rows, want %d", d.Table, rowsPerTable[d.Table], d.Rows)
+		}
+	}
+
+	for i, want := range map[int]string{0: `null`, 1: `""`, 2: `"it's"`, 8: `"AAH+/w=="`} {
+		if got := string(t1Rows[edgeCaseId(i)]["t1f1"]); got != want {
+			t.Errorf("t1f1 of row %d: got %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestStreamDump(t *testing.T) {
+	ctx := context.Background()
+	res, err := Activity(ctx, ActivityDump, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	streamRes, err := StreamDump(ctx, &buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamRes.Cmd != ActivityStream || streamRes.DumpFile != "" {
+		t.Errorf("unexpected result %s", streamRes)
+	}
+	gr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(streamed, readDumpFile(t, res.DumpFile)) {
+		t.Error("streamed dump differs from dump file")
+	}
+
+	// e.g. the http client went away - ends the dump, but is not fatal
+	_, err = StreamDump(ctx, &failingWriter{failAfter: 1 << 10}, nil)
+	if err != errWriteFailed {
+		t.Errorf("got err %v, want %v", err, errWriteFailed)
+	}
+}
+
+var errWriteFailed = errors.New("write failed")
+
+type failingWriter struct {
+	failAfter int
+	written   int
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if fw.written+len(p) > fw.failAfter {
+		return 0, errWriteFailed
+	}
+	fw.written += len(p)
+	return len(p), nil
+}
+
+func TestCodecs(t *testing.T) {
+	ctx := context.Background()
+	res, err := Activity(ctx, ActivityDump, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := readDumpFile(t, res.DumpFile)
+
+	for _, name := range []string{"none", "gzip-1", "gzip-9", "pgzip", "pgzip-1"} {
+		codec, err := CodecByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkCodec(t, codec, want)
+	}
+	// many members, written by fewer workers than blocks
+	checkCodec(t, &parallelGzipCodec{level: 6, blockSize: 1000, workers: 3}, want)
+
+	for _, name := range []string{"gzip-0", "gzip-10", "none-1", "zstd"} {
+		if _, err := CodecByName(name); err == nil {
+			t.Errorf("codec %s: expected an error", name)
+		}
+	}
+}
+
+func checkCodec(t *testing.T, codec Codec, want []byte) {
+	opts := DefaultActivityOptions()
+	opts.Codec = codec
+	res, err := Activity(context.Background(), ActivityDump, opts)
+	if err != nil {
+		t.Fatalf("%s: %v", codec.Name(), err)
+	}
+	if !strings.Contains(filepath.Base(res.DumpFile), "-"+codec.Name()+"-") || !strings.HasSuffix(res.DumpFile, ".sql"+codec.FileExt()) {
+		t.Errorf("%s: unexpected dump file name %s", codec.Name(), res.DumpFile)
+	}
+	if got := readDumpFile(t, res.DumpFile); !bytes.Equal(got, want) {
+		t.Errorf("%s: dump differs from the default codec's", codec.Name())
+	}
+}
+
+// gzip compressed or plain
+func readDumpFile(t *testing.T, fileName string) []byte {
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	br := bufio.NewReader(file)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		r, err = gzip.NewReader(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	dump, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dump
+}
+
+var freshDbs = 0
+
+func openFreshDb(t *testing.T) *sql.DB {
+	freshDbs++
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:restored-%d?mode=memory&cache=private&_fk=1", freshDbs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each connection would open another empty db
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func schemaSql(t *testing.T, db *sql.DB) string {
+	stmts, err := queryStrings(context.Background(), db,
+		`SELECT "type" || ' ' || "name" || ': ' || "sql" FROM "sqlite_master" WHERE "sql" NOT NULL ORDER BY "type", "name"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(stmts, "\n")
+}
+
+func TestStmtSplitter(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		stmts []string
+		lines []int
+	}{
+		{"plain", "A;\nB;", []string{"A", "B"}, []int{1, 2}},
+		{"missing final semicolon", "A;\n\nB", []string{"A", "B"}, []int{1, 3}},
+		{"empty statements", ";;A;;", []string{"A"}, []int{1}},
+		{"quotes", `I 'a;''b' "c;""d" ` + "`e;`" + ` [f;];X;`, []string{`I 'a;''b' "c;""d" ` + "`e;`" + ` [f;]`, "X"}, []int{1, 1}},
+		{"multi-line string", "I 'a\nb;\nc';\nX;", []string{"I 'a\nb;\nc'", "X"}, []int{1, 4}},
+		{"leading comments dropped", "-- c;\n/* d;\n*/ A;", []string{"A"}, []int{3}},
+		{"inner comments kept", "A /* ; */ B -- ;\n C;", []string{"A /* ; */ B -- ;\n C"}, []int{1}},
+		{"trigger", "CREATE TEMP TRIGGER t AFTER INSERT ON a BEGIN\n UPDATE a SET v = 'END;';\n DELETE FROM b;\nEND;\nX;",
+			[]string{"CREATE TEMP TRIGGER t AFTER INSERT ON a BEGIN\n UPDATE a SET v = 'END;';\n DELETE FROM b;\nEND", "X"}, []int{1, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			splitter := newStmtSplitter(bufio.NewReader(strings.NewReader(tt.input)))
+			for i := 0; ; i++ {
+				stmt, line, err := splitter.next()
+				if err == io.EOF {
+					if i != len(tt.stmts) {
+						t.Errorf("got %d statements, want %d", i, len(tt.stmts))
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i >= len(tt.stmts) {
+					t.Fatalf("unexpected statement %q", stmt)
+				}
+				if stmt != tt.stmts[i] || line != tt.lines[i] {
+					t.Errorf("statement %d: got %q at line %d, want %q at line %d", i, stmt, line, tt.stmts[i], tt.lines[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreReportsLine(t *testing.T) {
+	db := openFreshDb(t)
+	_, err := Restore(context.Background(), db, strings.NewReader("CREATE TABLE a (v);\nINSERT INTO a VALUES ('x\ny');\n\nINSERT INTO b VALUES (1);\n"), nil)
+	restoreErr, ok := err.(*RestoreError)
+	if !ok {
+		t.Fatalf("got %T %v, want *RestoreError", err, err)
+	}
+	if restoreErr.Line != 5 {
+		t.Errorf("got line %d, want 5", restoreErr.Line)
+	}
+
+	_, err = Restore(context.Background(), openFreshDb(t), strings.NewReader("SELECT 1;\nSELECT 'unterminated;\n"), nil)
+	if restoreErr, ok = err.(*RestoreError); !ok || restoreErr.Line != 2 {
+		t.Errorf("got %v, want *RestoreError at line 2", err)
+	}
+}
@@ -0,0 +1,596 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"gopkg.in/errgo.v2/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ChainManifestSuffix = ".chain.json"
+
+const ChainDumpFull = "full"
+const ChainDumpIncremental = "incremental"
+
+/*
+ * a chain of sql dumps: a full one followed by incrementals, each relative to its predecessor - restoring them in order
+ * (see RestoreChain) recreates the db as of the last one. file names are relative to the manifest's directory.
+ */
+type ChainManifest struct {
+	Chain        string      `json:"chain"`
+	Version      int         `json:"version"`
+	SchemaSha256 string      `json:"schemaSha256"` // of the dumped schema incl. DumpFilter predicates and Masking rules - a change starts a new chain
+	State        string      `json:"state"`        // content hashes per primary key as of the last dump
+	Dumps        []ChainDump `json:"dumps"`
+}
+
+type ChainDump struct {
+	Seq       int       `json:"seq"`
+	Kind      string    `json:"kind"`
+	File      string    `json:"file"`
+	Codec     string    `json:"codec"`
+	CreatedAt time.Time `json:"createdAt"`
+	// rows of an incremental dump - a changed table without usable primary key is replaced as a whole and not counted
+	Inserts int64 `json:"inserts"`
+	Updates int64 `json:"updates"`
+	Deletes int64 `json:"deletes"`
+}
+
+func (d *ChainDump) String() string {
+	if d.Kind == ChainDumpFull {
+		return fmt.Sprintf("#%d %s", d.Seq, d.Kind)
+	}
+	return fmt.Sprintf("#%d %s inserts=%d updates=%d deletes=%d", d.Seq, d.Kind, d.Inserts, d.Updates, d.Deletes)
+}
+
+/*
+ * the dumps of ActivityOptions.Chain: the first dump of a chain is a full one, every further one only holds the rows
+ * inserted, updated (as upserts) or deleted since its predecessor. which rows changed is told by a hash of each row's
+ * content per primary key, kept in a sqlite file next to the dumps (see buildChainState) - so a chain may grow as large
+ * as the db without bloating the process. dumps of a chain run one at a time.
+ * NOTE: sql format only. a changed schema (or ActivityOptions.Filter) starts a new chain. as upserts are applied in
+ * primary key order, a row taking over the value of another row's UNIQUE column within the same incremental fails to
+ * restore.
+ */
+type DumpChain struct {
+	mu       sync.Mutex
+	manifest *ChainManifest // nil before the first dump
+}
+
+func NewDumpChain() *DumpChain {
+	return &DumpChain{}
+}
+
+/*
+ * writes the next dump of the chain and updates its manifest - sets DumpFile, ChainManifest and ChainDump of res
+ */
+func (c *DumpChain) dump(ctx context.Context, db *sql.DB, readers *sql.DB, opts *ActivityOptions, res *ActivityResult) error {
+	if opts.Format != FormatSql {
+		return errors.New(fmt.Sprintf("incremental dumps are sql only, not %s", opts.Format))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	schema, err := getDumpSchema(ctx, db, opts.Filter, opts.Masking)
+	if err != nil {
+		return err
+	}
+	dir := TempDir()
+	prev := c.manifest
+	manifest := prev
+	schemaSum := schemaSha256(schema)
+	if manifest == nil || manifest.SchemaSha256 != schemaSum {
+		id := time.Now().Format("20060102150405") + "-" + uuid.New().String()[:8]
+		manifest = &ChainManifest{Chain: id, Version: 1, SchemaSha256: schemaSum}
+	}
+	entry := ChainDump{Seq: len(manifest.Dumps), Kind: ChainDumpIncremental, Codec: opts.Codec.Name(), CreatedAt: time.Now().UTC()}
+	if entry.Seq == 0 {
+		entry.Kind = ChainDumpFull
+	}
+
+	// becomes the chain's state once the dump is listed in the manifest
+	stateTemp, err := tempSpace.createTemp(".chain-state-*.db")
+	if err != nil {
+		return err
+	}
+	_ = stateTemp.Close()
+	defer func() {
+		_ = tempSpace.removeTemp(stateTemp.Name()) // a no-op once kept
+	}()
+	err = buildChainState(ctx, db, schema, stateTemp.Name())
+	if err != nil {
+		return err
+	}
+
+	fileName, err := writeDumpFile(fmt.Sprintf("chain-%s-%03d-%s-*.sql", manifest.Chain, entry.Seq, entry.Kind), opts.Codec, func(w io.Writer) error {
+		if entry.Kind == ChainDumpFull {
+			return alternativeDump(ctx, db, readers, w, opts.SqlDump, opts.Filter, opts.Masking, opts.Progress)
+		}
+		res.DumpWorkers = 1 // changed rows only, one after another
+		return incrementalDump(ctx, db, schema, filepath.Join(dir, manifest.State), stateTemp.Name(), w, &entry, opts)
+	})
+	if err != nil {
+		return err
+	}
+
+	stateFile := filepath.Join(dir, fmt.Sprintf("chain-%s-%03d.state.db", manifest.Chain, entry.Seq))
+	next := *manifest
+	next.State = filepath.Base(stateFile)
+	entry.File = filepath.Base(fileName)
+	next.Dumps = append(append([]ChainDump(nil), manifest.Dumps...), entry)
+	manifestFile := chainManifestFile(next.Chain)
+	err = tempSpace.keep(stateTemp.Name(), stateFile)
+	if err == nil {
+		err = writeChainManifest(manifestFile, &next)
+		if err != nil {
+			_ = os.Remove(stateFile)
+		}
+	}
+	if err != nil {
+		_ = os.Remove(fileName)
+		return err
+	}
+
+	// only the last state is of use - also none of a chain that cannot be continued anymore
+	if prev != nil && prev.State != "" {
+		err = os.Remove(filepath.Join(dir, prev.State))
+		if err != nil {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("failed to remove chain state %s - err: %+v", prev.State, err) + "\n")
+		}
+	}
+	c.manifest = &next
+	res.DumpFile, res.ChainManifest, res.ChainDump = fileName, manifestFile, &entry
+	return nil
+}
+
+/*
+ * the manifest of the chain further dumps continue, "" before the first dump
+ */
+func (c *DumpChain) liveManifest() string {
+	if c == nil {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.manifest == nil {
+		return ""
+	}
+	return chainManifestFile(c.manifest.Chain)
+}
+
+func chainManifestFile(chain string) string {
+	return filepath.Join(TempDir(), "chain-"+chain+ChainManifestSuffix)
+}
+
+/*
+ * the files of a chain, the manifest last - a manifest that cannot be read stands for itself only
+ */
+func chainFiles(manifestFile string) []string {
+	manifest, err := readChainManifest(manifestFile)
+	if err != nil {
+		return []string{manifestFile}
+	}
+	dir := filepath.Dir(manifestFile)
+	files := make([]string, 0, len(manifest.Dumps)+2)
+	for _, d := range manifest.Dumps {
+		files = append(files, filepath.Join(dir, d.File))
+	}
+	if manifest.State != "" {
+		files = append(files, filepath.Join(dir, manifest.State))
+	}
+	return append(files, manifestFile)
+}
+
+// written next to the manifest and renamed, so there is always a complete one
+func writeChainManifest(manifestFile string, manifest *ChainManifest) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := tempSpace.createTemp(".chain-manifest-*.json")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = tempSpace.keep(file.Name(), manifestFile)
+	}
+	if err != nil {
+		_ = tempSpace.removeTemp(file.Name())
+	}
+	return err
+}
+
+func readChainManifest(manifestFile string) (*ChainManifest, error) {
+	content, err := os.ReadFile(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &ChainManifest{}
+	err = json.Unmarshal(content, manifest)
+	if err != nil {
+		return nil, errors.Because(err, err, "invalid chain manifest "+manifestFile)
+	}
+	return manifest, nil
+}
+
+func schemaSha256(schema *Schema) string {
+	h := sha256.New()
+	for _, entries := range [][]*SchemaEntry{schema.tables, schema.internal, schema.indexes, schema.triggers, schema.views} {
+		for _, entry := range entries {
+			_, _ = io.WriteString(h, entry.sql+";\n")
+			if entry.where != "" {
+				_, _ = io.WriteString(h, "WHERE "+entry.where+";\n")
+			}
+			if entry.masker != nil {
+				_, _ = io.WriteString(h, "MASK "+entry.masker.String()+";\n")
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+/*
+ * the state of a db as of a dump: per table and row the primary key (as sql literals, e.g. `'abc', 2`) and a hash of
+ * the row's content as dumped. a table without usable primary key (see chainKeyColumns) gets a single row with an
+ * empty key hashing the whole table. the key of a row is the one to look it up in db, its masked counterpart (mkey, NULL if not masked) the one
+ * to delete it by in the dumped db - see Masking.
+ */
+func buildChainState(ctx context.Context, db *sql.DB, schema *Schema, stateFile string) error {
+	state, err := sql.Open("sqlite3", "file:"+stateFile+"?mode=rwc&_journal_mode=OFF&_sync=OFF")
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+	state.SetMaxOpenConns(1)
+
+	_, err = state.ExecContext(ctx, "CREATE TABLE state (tbl TEXT NOT NULL, key TEXT NOT NULL, mkey TEXT, hash BLOB NOT NULL, PRIMARY KEY (tbl, key)) WITHOUT ROWID")
+	if err != nil {
+		return err
+	}
+	tx, err := state.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback() // a no-op once committed
+	}()
+	ins, err := tx.PrepareContext(ctx, "INSERT INTO state (tbl, key, mkey, hash) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+
+	for _, table := range append(schema.tables, schema.internal...) {
+		tableInfo, err := getTableInfo(ctx, db, table.name)
+		if err != nil {
+			return err
+		}
+		pkCols, err := chainKeyColumns(ctx, db, table, tableInfo)
+		if err != nil {
+			return err
+		}
+		tableHash := sha256.New()
+		var row, key, mkey strings.Builder
+		unmasked := *table
+		unmasked.masker = nil
+		err = forEachRow(ctx, db, &unmasked, tableInfo, nil, func(vals []interface{}) error {
+			key.Reset()
+			if pkCols != nil {
+				appendKey(&key, vals, tableInfo, pkCols)
+			}
+			table.masker.mask(vals)
+			row.Reset()
+			appendValueList(&row, vals, tableInfo)
+			if pkCols == nil {
+				_, _ = io.WriteString(tableHash, row.String()+"\n")
+				return nil
+			}
+			var maskedKey interface{}
+			if table.masker != nil {
+				mkey.Reset()
+				appendKey(&mkey, vals, tableInfo, pkCols)
+				if mkey.String() != key.String() {
+					maskedKey = mkey.String()
+				}
+			}
+			sum := sha256.Sum256([]byte(row.String()))
+			_, err := ins.ExecContext(ctx, table.name, key.String(), maskedKey, sum[:16])
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if pkCols == nil {
+			_, err = ins.ExecContext(ctx, table.name, "", nil, tableHash.Sum(nil)[:16])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+/*
+ * the rows of db differing between the states prevStateFile and stateFile: DELETEs of rows gone, then upserts of rows
+ * inserted or changed - ordered by primary key, so the same change always gives the same dump. the triggers restored by
+ * the full dump are dropped meanwhile and recreated afterwards, so replaying the changes does not fire them - the db
+ * dumped holds their effects already.
+ */
+func incrementalDump(ctx context.Context, db *sql.DB, schema *Schema, prevStateFile string, stateFile string, w io.Writer, entry *ChainDump, opts *ActivityOptions) error {
+	state, err := sql.Open("sqlite3", "file:"+stateFile+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+	state.SetMaxOpenConns(1)
+	_, err = state.ExecContext(ctx, "ATTACH DATABASE ? AS prev", prevStateFile)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write([]byte("PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\n"))
+	failOnErr("write tx begin", err)
+	for _, trigger := range schema.triggers {
+		_, err = w.Write([]byte("DROP TRIGGER IF EXISTS " + quoteIdent(trigger.name) + ";\n"))
+		failOnErr("write drop trigger", err)
+	}
+
+	iw := &insWriter{file: w, opts: opts.SqlDump}
+	for _, table := range append(schema.tables, schema.internal...) {
+		tableInfo, err := getTableInfo(ctx, db, table.name)
+		if err != nil {
+			return err
+		}
+		pkCols, err := chainKeyColumns(ctx, db, table, tableInfo)
+		if err != nil {
+			return err
+		}
+		var prevWhole bool // keyed as a whole by the previous state - e.g. while a key was NULL
+		if pkCols != nil {
+			err = state.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM prev.state WHERE tbl = ? AND key = '')", table.name).Scan(&prevWhole)
+			if err != nil {
+				return err
+			}
+		}
+		if pkCols == nil || prevWhole {
+			err = replaceChangedTable(ctx, db, state, table, tableInfo, iw, opts.Progress)
+		} else {
+			err = dumpTableChanges(ctx, db, state, table, tableInfo, pkCols, iw, entry, opts.Progress)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	dumpDDL("write triggers", schema.triggers, w)
+	_, err = w.Write([]byte("COMMIT;\n"))
+	failOnErr("write commit", err)
+	return nil
+}
+
+func dumpTableChanges(ctx context.Context, db *sql.DB, state *sql.DB, table *SchemaEntry, tableInfo *TableInfo, pkCols []int, iw *insWriter, entry *ChainDump, progress ProgressFunc) error {
+	tableName := table.name
+	pkNames := make([]string, 0, len(pkCols))
+	for _, i := range pkCols {
+		pkNames = append(pkNames, quoteIdent(tableInfo.columnInfos[i].colName))
+	}
+	pkList := strings.Join(pkNames, ", ")
+
+	deleted, err := state.QueryContext(ctx, "SELECT coalesce(p.mkey, p.key) FROM prev.state p WHERE p.tbl = ? AND NOT EXISTS "+
+		"(SELECT 1 FROM main.state n WHERE n.tbl = p.tbl AND n.key = p.key) ORDER BY p.key", tableName)
+	if err != nil {
+		return err
+	}
+	defer deleted.Close()
+	var key string
+	for deleted.Next() {
+		err = deleted.Scan(&key)
+		if err != nil {
+			return err
+		}
+		iw.writeStmt("DELETE FROM " + quoteIdent(tableName) + " WHERE (" + pkList + ") = (" + key + ");\n")
+		entry.Deletes++
+	}
+	if err = deleted.Err(); err != nil {
+		return err
+	}
+
+	changed, err := state.QueryContext(ctx, "SELECT n.key, p.key IS NULL FROM main.state n LEFT JOIN prev.state p "+
+		"ON p.tbl = n.tbl AND p.key = n.key WHERE n.tbl = ? AND (p.key IS NULL OR p.hash != n.hash) ORDER BY n.key", tableName)
+	if err != nil {
+		return err
+	}
+	defer changed.Close()
+
+	insPrefix, onConflict := upsertClauses(tableName, tableInfo, pkList)
+	selectRow := "SELECT " + rawColumnList(tableInfo) + " FROM " + quoteIdent(tableName) + " WHERE (" + pkList + ") = "
+	vals := make([]interface{}, len(tableInfo.columnInfos))
+	ptrs := make([]interface{}, len(vals))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	var inserted bool
+	var stmt strings.Builder
+	var rows int64
+	for changed.Next() {
+		err = changed.Scan(&key, &inserted)
+		if err != nil {
+			return err
+		}
+		err = db.QueryRowContext(ctx, selectRow+"("+key+")").Scan(ptrs...)
+		if cErr := cancelledErr(ctx, err); cErr != nil {
+			return cErr
+		}
+		if err != nil {
+			return errors.Because(err, err, fmt.Sprintf("query changed row (%s) of %s", key, tableName))
+		}
+		table.masker.mask(vals)
+
+		stmt.Reset()
+		stmt.WriteString(insPrefix)
+		appendValueList(&stmt, vals, tableInfo)
+		stmt.WriteString(onConflict)
+		iw.writeStmt(stmt.String())
+		if inserted {
+			entry.Inserts++
+		} else {
+			entry.Updates++
+		}
+		rows++
+	}
+	if err = changed.Err(); err != nil {
+		return err
+	}
+	progress.report(Progress{Phase: ProgressDump, Table: tableName, Rows: rows, Done: true})
+	return nil
+}
+
+// a table without usable primary key is dumped as a whole, if changed at all
+func replaceChangedTable(ctx context.Context, db *sql.DB, state *sql.DB, table *SchemaEntry, tableInfo *TableInfo, iw *insWriter, progress ProgressFunc) error {
+	tableName := table.name
+	var changed bool
+	err := state.QueryRowContext(ctx, "SELECT NOT EXISTS (SELECT 1 FROM main.state n JOIN prev.state p "+
+		"ON p.tbl = n.tbl AND p.key = n.key AND p.hash = n.hash WHERE n.tbl = ?)", tableName).Scan(&changed)
+	if err != nil || !changed {
+		return err
+	}
+	_, err = iw.file.Write([]byte("DELETE FROM " + quoteIdent(tableName) + ";\n"))
+	failOnErr("write delete", err)
+	return dumpInsStmts(ctx, db, table, tableInfo, iw, progress)
+}
+
+/*
+ * `INSERT INTO "t"("id", "v") VALUES` and ` ON CONFLICT("id") DO UPDATE SET "v"=excluded."v";` (resp. DO NOTHING if
+ * all columns are part of the primary key)
+ */
+func upsertClauses(tableName string, tableInfo *TableInfo, pkList string) (string, string) {
+	colNames := make([]string, 0, len(tableInfo.columnInfos))
+	updates := make([]string, 0, len(tableInfo.columnInfos))
+	for _, ci := range tableInfo.columnInfos {
+		colNames = append(colNames, quoteIdent(ci.colName))
+		if ci.pk == 0 {
+			updates = append(updates, quoteIdent(ci.colName)+"=excluded."+quoteIdent(ci.colName))
+		}
+	}
+	insPrefix := "INSERT INTO " + quoteIdent(tableName) + "(" + strings.Join(colNames, ", ") + ") VALUES"
+	if len(updates) == 0 {
+		return insPrefix, " ON CONFLICT(" + pkList + ") DO NOTHING;\n"
+	}
+	return insPrefix, " ON CONFLICT(" + pkList + ") DO UPDATE SET " + strings.Join(updates, ", ") + ";\n"
+}
+
+// indexes of the primary key columns in key order, nil if the table has none
+func primaryKeyColumns(tableInfo *TableInfo) []int {
+	var pkCols []int
+	for i, ci := range tableInfo.columnInfos {
+		if ci.pk > 0 {
+			pkCols = append(pkCols, i)
+		}
+	}
+	sort.Slice(pkCols, func(i, j int) bool { return tableInfo.columnInfos[pkCols[i]].pk < tableInfo.columnInfos[pkCols[j]].pk })
+	return pkCols
+}
+
+/*
+ * the primary key columns to tell the rows of table apart by, nil if there are none or a row (as dumped) has a NULL
+ * key: a primary key of a rowid table may be NULL, any number of times - neither `(pk) = (NULL)` finds such a row nor
+ * does its upsert conflict with it
+ */
+func chainKeyColumns(ctx context.Context, db *sql.DB, table *SchemaEntry, tableInfo *TableInfo) ([]int, error) {
+	pkCols := primaryKeyColumns(tableInfo)
+	if pkCols == nil {
+		return nil, nil
+	}
+	nulls := make([]string, 0, len(pkCols))
+	for _, i := range pkCols {
+		nulls = append(nulls, quoteIdent(tableInfo.columnInfos[i].colName)+" IS NULL")
+	}
+	query := "SELECT EXISTS (SELECT 1 FROM " + quoteIdent(table.name) + " WHERE (" + strings.Join(nulls, " OR ") + ")"
+	if table.where != "" {
+		query += " AND (" + table.where + ")"
+	}
+	var nullKey bool
+	err := db.QueryRowContext(ctx, query+")").Scan(&nullKey)
+	if cErr := cancelledErr(ctx, err); cErr != nil {
+		return nil, cErr
+	}
+	if err != nil || nullKey {
+		return nil, err
+	}
+	return pkCols, nil
+}
+
+// `(v1, v2, ...)` like a row of an INSERT
+func appendValueList(sb *strings.Builder, vals []interface{}, tableInfo *TableInfo) {
+	sb.WriteByte('(')
+	for i, v := range vals {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		appendValue(sb, v, tableInfo.columnInfos[i].affinity)
+	}
+	sb.WriteByte(')')
+}
+
+func appendKey(sb *strings.Builder, vals []interface{}, tableInfo *TableInfo, pkCols []int) {
+	for i, col := range pkCols {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		appendValue(sb, vals[col], tableInfo.columnInfos[col].affinity)
+	}
+}
+
+/*
+ * restores the dumps of a chain manifest (see DumpChain) in order into db
+ */
+func RestoreChain(ctx context.Context, db *sql.DB, manifestFile string, opts *RestoreOptions) (*RestoreResult, error) {
+	manifest, err := readChainManifest(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	total := &RestoreResult{}
+	for _, d := range manifest.Dumps {
+		res, err := restoreFile(ctx, db, filepath.Join(filepath.Dir(manifestFile), d.File), opts)
+		if res != nil {
+			total.Statements += res.Statements
+			total.Transactions += res.Transactions
+			total.Lines += res.Lines
+			total.ForeignKeyViolations = res.ForeignKeyViolations // as of the last one
+			total.Duration += res.Duration
+		}
+		if err != nil {
+			return total, errors.Because(err, err, fmt.Sprintf("restoring %s of chain %s", d.File, manifest.Chain))
+		}
+	}
+	return total, nil
+}
+
+// a dump file or a chain manifest
+func restoreFile(ctx context.Context, db *sql.DB, dumpFile string, opts *RestoreOptions) (*RestoreResult, error) {
+	if strings.HasSuffix(dumpFile, ChainManifestSuffix) {
+		return RestoreChain(ctx, db, dumpFile, opts)
+	}
+	file, err := os.Open(dumpFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Restore(ctx, db, file, opts)
+}
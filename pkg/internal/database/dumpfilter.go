@@ -0,0 +1,208 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/errgo.v2/errors"
+	"path"
+	"sort"
+	"strings"
+)
+
+/*
+ * narrows a dump down to a targeted extract: tables by name - include resp. exclude patterns (see path.Match,
+ * case-insensitive like sqlite's names) - and the rows of a table by a WHERE predicate, e.g. `t6f1 >= '2022-01-05'`
+ * for t6. indexes and triggers of excluded tables are left out, views are kept. sqlite's internal tables (e.g.
+ * sqlite_sequence) are always dumped as a whole.
+ * the filter is checked against the snapshot before the dump starts - a *DumpFilterError if it does not fit.
+ * NOTE: the main db is not touched, filtering happens on the snapshot only
+ */
+type DumpFilter struct {
+	Include []string          // table patterns, empty: all tables
+	Exclude []string          // table patterns, applied after Include
+	Where   map[string]string // per table name (case-insensitive, one per table): the rows to dump, an sql expression over the table's columns
+}
+
+func (f *DumpFilter) String() string {
+	if f == nil {
+		return ""
+	}
+	var parts []string
+	if len(f.Include) > 0 {
+		parts = append(parts, "include="+strings.Join(f.Include, ","))
+	}
+	if len(f.Exclude) > 0 {
+		parts = append(parts, "exclude="+strings.Join(f.Exclude, ","))
+	}
+	tables := make([]string, 0, len(f.Where))
+	for table := range f.Where {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		parts = append(parts, fmt.Sprintf("where[%s]=%s", table, f.Where[table]))
+	}
+	return strings.Join(parts, " ")
+}
+
+/*
+ * a filter not fitting the dumped db, e.g. a predicate referring to an unknown column
+ */
+type DumpFilterError struct {
+	Table string // the predicate is about, "" if about the patterns
+	Err   error
+}
+
+func (e *DumpFilterError) Error() string {
+	if e.Table == "" {
+		return fmt.Sprintf("invalid dump filter: %v", e.Err)
+	}
+	return fmt.Sprintf("invalid dump filter for table %s: %v", e.Table, e.Err)
+}
+
+func (e *DumpFilterError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DumpFilterError) Cause() error {
+	return e.Err
+}
+
+/*
+ * the schema of db as dumped with filter and masking (nil: all of it, as is) - tables carry their predicates and
+ * maskers, see SchemaEntry
+ */
+func getDumpSchema(ctx context.Context, db queryer, filter *DumpFilter, masking *Masking) (*Schema, error) {
+	schema, err := getSchema(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if masking != nil {
+		// rules of excluded tables are still checked
+		err = masking.apply(ctx, db, schema)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if filter == nil {
+		return schema, nil
+	}
+	return filter.apply(ctx, db, schema)
+}
+
+func (f *DumpFilter) apply(ctx context.Context, db queryer, schema *Schema) (*Schema, error) {
+	for _, pattern := range append(append([]string(nil), f.Include...), f.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, &DumpFilterError{Err: errors.New(fmt.Sprintf("pattern %q: %v", pattern, err))}
+		}
+	}
+
+	filtered := &Schema{views: schema.views, internal: schema.internal}
+	dumped := make(map[string]*SchemaEntry)
+	excluded := make(map[string]bool)
+	for _, table := range schema.tables {
+		if (len(f.Include) == 0 || matchesAny(f.Include, table.name)) && !matchesAny(f.Exclude, table.name) {
+			filtered.tables = append(filtered.tables, table)
+			dumped[strings.ToLower(table.name)] = table
+		} else {
+			excluded[strings.ToLower(table.name)] = true
+		}
+	}
+	// those of a view stay
+	for _, entry := range schema.indexes {
+		if !excluded[strings.ToLower(entry.tblName)] {
+			filtered.indexes = append(filtered.indexes, entry)
+		}
+	}
+	for _, entry := range schema.triggers {
+		if !excluded[strings.ToLower(entry.tblName)] {
+			filtered.triggers = append(filtered.triggers, entry)
+		}
+	}
+
+	// sqlite's names are case-insensitive - which of two predicates for the same table should apply is anyone's guess
+	whereTables := make(map[string]string, len(f.Where))
+	for tableName := range f.Where {
+		other, dup := whereTables[strings.ToLower(tableName)]
+		if dup {
+			names := []string{other, tableName}
+			sort.Strings(names)
+			return nil, &DumpFilterError{Table: names[0], Err: errors.New(fmt.Sprintf("predicates for both %s and %s", names[0], names[1]))}
+		}
+		whereTables[strings.ToLower(tableName)] = tableName
+	}
+	for tableName, where := range f.Where {
+		table := dumped[strings.ToLower(tableName)]
+		if table == nil {
+			return nil, &DumpFilterError{Table: tableName, Err: errors.New("no such table or not dumped")}
+		}
+		err := checkPredicate(ctx, db, table.name, where)
+		if err != nil {
+			if cErr := cancelledErr(ctx, err); cErr != nil {
+				return nil, cErr
+			}
+			return nil, &DumpFilterError{Table: tableName, Err: err}
+		}
+		table.where = where
+	}
+	return filtered, nil
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * a predicate is a single expression - no `;`, comment or unbalanced `)` outside of quotes, so it cannot change the
+ * query it is put into. sqlite then evaluates it over the table - a failure on a row's value (e.g. json() of a text
+ * not being json) shows before the dump starts, at the cost of reading the table's rows once more.
+ */
+func checkPredicate(ctx context.Context, db queryer, tableName string, where string) error {
+	if strings.TrimSpace(where) == "" {
+		return errors.New("empty predicate")
+	}
+	depth := 0
+	for i := 0; i < len(where); i++ {
+		c := where[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			closing := c
+			if c == '[' {
+				closing = ']'
+			}
+			end := strings.IndexByte(where[i+1:], closing)
+			if end < 0 {
+				return errors.New(fmt.Sprintf("unterminated quote in %q", where))
+			}
+			i += end + 1 // a doubled quote is just two quoted parts in a row
+		case c == ';':
+			return errors.New(fmt.Sprintf("';' in %q - a single expression expected", where))
+		case c == '-' && i+1 < len(where) && where[i+1] == '-', c == '/' && i+1 < len(where) && where[i+1] == '*':
+			return errors.New(fmt.Sprintf("comment in %q", where))
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth < 0 {
+				return errors.New(fmt.Sprintf("unbalanced ')' in %q", where))
+			}
+		}
+	}
+	if depth != 0 {
+		return errors.New(fmt.Sprintf("unbalanced '(' in %q", where))
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT count(*) FROM "+quoteIdent(tableName)+" WHERE ("+where+")")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"gopkg.in/errgo.v2/errors"
+	"io"
+	"strings"
+)
+
+/*
+ * what dumpToFile writes into its compressed stream - see Codec
+ */
+type DumpFormat string
+
+const FormatSql DumpFormat = "sql"     // restorable sql script, see alternativeDump
+const FormatCsv DumpFormat = "csv"     // tar archive of one csv per table plus manifest, see csvDump
+const FormatJsonl DumpFormat = "jsonl" // a json object per row, see jsonlDump
+const DefaultDumpFormat = FormatSql
+
+var dumpFormats = []DumpFormat{FormatSql, FormatCsv, FormatJsonl}
+
+func DumpFormatByName(name string) (DumpFormat, error) {
+	names := make([]string, 0, len(dumpFormats))
+	for _, f := range dumpFormats {
+		if strings.EqualFold(string(f), name) {
+			return f, nil
+		}
+		names = append(names, string(f))
+	}
+	return "", errors.New(fmt.Sprintf("unknown dump format %q - expected one of: %s", name, strings.Join(names, ", ")))
+}
+
+// file name extension of an uncompressed dump in this format - see Codec.FileExt
+func (f DumpFormat) fileExt() string {
+	if f == FormatCsv {
+		return ".csv.tar"
+	}
+	return "." + string(f)
+}
+
+// readers are only used by FormatSql, nil for a sequential dump
+func (f DumpFormat) dump(ctx context.Context, db *sql.DB, readers *sql.DB, w io.Writer, opts *ActivityOptions) error {
+	switch f {
+	case FormatSql:
+		return alternativeDump(ctx, db, readers, w, opts.SqlDump, opts.Filter, opts.Masking, opts.Progress)
+	case FormatCsv:
+		return csvDump(ctx, db, w, opts.Codec.Name(), opts.Filter, opts.Masking, opts.Progress)
+	case FormatJsonl:
+		return jsonlDump(ctx, db, w, opts.Filter, opts.Masking, opts.Progress)
+	default:
+		return errors.New(fmt.Sprintf("unknown dump format %q", f))
+	}
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+ * one json object per row and line: `{"table":"t1","row":{"id":"...","t1f1":null,...}}`, columns in table order.
+ * storage classes map to json types: NULL -> null, INTEGER/REAL -> number, TEXT -> string, BLOB -> base64 string.
+ * json has no infinity, so such REALs become the strings "Infinity"/"-Infinity".
+ * NOTE: text that is not valid utf-8 gets its invalid bytes replaced by U+FFFD
+ */
+func jsonlDump(ctx context.Context, db *sql.DB, w io.Writer, filter *DumpFilter, masking *Masking, progress ProgressFunc) error {
+	schema, err := getDumpSchema(ctx, db, filter, masking)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriterSize(w, 1<<16)
+	for _, table := range schema.tables {
+		tableInfo, err := getTableInfo(ctx, db, table.name)
+		if err != nil {
+			return err
+		}
+
+		// `{"table":"t1","row":{` resp. `"id":` are the same for all rows
+		prefix := `{"table":` + jsonString(table.name) + `,"row":{`
+		colKeys := make([]string, 0, len(tableInfo.columnInfos))
+		for _, ci := range tableInfo.columnInfos {
+			colKeys = append(colKeys, jsonString(ci.colName)+":")
+		}
+
+		var sb strings.Builder
+		err = forEachRow(ctx, db, table, tableInfo, progress, func(vals []interface{}) error {
+			sb.Reset()
+			sb.WriteString(prefix)
+			for i, v := range vals {
+				if i > 0 {
+					sb.WriteByte(',')
+				}
+				sb.WriteString(colKeys[i])
+				appendJsonValue(&sb, v)
+			}
+			sb.WriteString("}}\n")
+			_, err := bw.WriteString(sb.String())
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func appendJsonValue(sb *strings.Builder, v interface{}) {
+	switch val := v.(type) {
+	case nil:
+		sb.WriteString("null")
+	case int64:
+		sb.WriteString(strconv.FormatInt(val, 10))
+	case float64:
+		switch {
+		case math.IsInf(val, 1):
+			sb.WriteString(`"Infinity"`)
+		case math.IsInf(val, -1):
+			sb.WriteString(`"-Infinity"`)
+		default:
+			sb.WriteString(strconv.FormatFloat(val, 'g', -1, 64))
+		}
+	case []byte:
+		sb.WriteByte('"')
+		sb.WriteString(base64.StdEncoding.EncodeToString(val))
+		sb.WriteByte('"')
+	case string:
+		sb.WriteString(jsonString(val))
+	default:
+		sb.WriteString(jsonString(fmt.Sprint(val)))
+	}
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s) // never fails for a string
+	return string(b)
+}
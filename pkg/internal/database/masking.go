@@ -0,0 +1,470 @@
+package database
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"gopkg.in/errgo.v2/errors"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+ * how a masked column's values get replaced in a dump - NULL always stays NULL, the storage class is kept:
+ *   redact    a constant: 'REDACTED', an empty blob, 0
+ *   hash      the hex HMAC-SHA256 of the value, keyed by Masking.Salt - resp. an integer, a real in [0, 1) or the raw
+ *             32 bytes derived from it
+ *   fake      a random value of the same format: letters by letters of the same case, digits by digits, anything else
+ *             kept - an integer with as many digits, a real of the same magnitude, a blob of the same length. the
+ *             randomness is derived from the HMAC, as above.
+ *   truncate  text (resp. blob) cut to its first n characters (bytes), e.g. `truncate-8` - numbers are kept
+ * hash and fake depend on salt and value only, not on table or column - so an id masked alike wherever it is used
+ * (e.g. t1.id and the t2.id referencing it) still joins.
+ * NOTE: no method is injective - distinct values may be masked alike, and a masked dump then fails to restore into a
+ * PRIMARY KEY or UNIQUE column. redact and truncate are rejected for these. a fake of a short value (e.g. a 1-digit
+ * integer, 10 fakes only) collides easily, a hash hardly ever. a hash does not keep the value's format though - a
+ * column with a CHECK on it (as the ids of the generated schema) takes fake.
+ */
+type MaskMethod string
+
+const MaskRedact MaskMethod = "redact"
+const MaskHash MaskMethod = "hash"
+const MaskFake MaskMethod = "fake"
+const MaskTruncate MaskMethod = "truncate"
+
+var maskMethods = []MaskMethod{MaskRedact, MaskHash, MaskFake, MaskTruncate}
+
+const maskRedactedText = "REDACTED"
+
+type MaskRule struct {
+	Table  string
+	Column string
+	Method MaskMethod
+	Length int // of MaskTruncate
+}
+
+/*
+ * a rule for table.column by method name - truncate takes its length as suffix, e.g. `truncate-8`
+ */
+func NewMaskRule(table string, column string, method string) (MaskRule, error) {
+	rule := MaskRule{Table: table, Column: column}
+	if table == "" || column == "" {
+		return rule, errors.New(fmt.Sprintf("invalid mask rule column %s.%s", table, column))
+	}
+	baseName := method
+	if i := strings.LastIndexByte(method, '-'); i > 0 {
+		n, err := strconv.Atoi(method[i+1:])
+		if err != nil || n < 0 {
+			return rule, errors.New(fmt.Sprintf("invalid length in %q", method))
+		}
+		baseName, rule.Length = method[:i], n
+	}
+	names := make([]string, 0, len(maskMethods))
+	for _, m := range maskMethods {
+		names = append(names, string(m))
+		if !strings.EqualFold(string(m), baseName) {
+			continue
+		}
+		if (m == MaskTruncate) != (baseName != method) {
+			return rule, errors.New(fmt.Sprintf("invalid mask method %q - only truncate takes a length, and requires one", method))
+		}
+		rule.Method = m
+		return rule, nil
+	}
+	return rule, errors.New(fmt.Sprintf("unknown mask method %q - expected one of: %s (truncate with length, e.g. truncate-8)", method, strings.Join(names, ", ")))
+}
+
+func (r MaskRule) String() string {
+	if r.Method == MaskTruncate {
+		return fmt.Sprintf("%s.%s=%s-%d", r.Table, r.Column, r.Method, r.Length)
+	}
+	return fmt.Sprintf("%s.%s=%s", r.Table, r.Column, r.Method)
+}
+
+/*
+ * the masking rules applied to every dump (see ActivityOptions.Masking) - at most one per column, the last one wins
+ */
+type Masking struct {
+	Salt  string // keys hash and fake - required by them
+	Rules []MaskRule
+}
+
+func (m *Masking) String() string {
+	if m == nil {
+		return ""
+	}
+	rules := make([]string, 0, len(m.Rules))
+	for _, r := range m.Rules {
+		rules = append(rules, r.String())
+	}
+	return strings.Join(rules, " ")
+}
+
+/*
+ * masking rules not fitting the dumped db, e.g. naming an unknown column
+ */
+type MaskingError struct {
+	Rule string // "" if not about a specific rule
+	Err  error
+}
+
+func (e *MaskingError) Error() string {
+	if e.Rule == "" {
+		return fmt.Sprintf("invalid masking: %v", e.Err)
+	}
+	return fmt.Sprintf("invalid mask rule %s: %v", e.Rule, e.Err)
+}
+
+func (e *MaskingError) Unwrap() error {
+	return e.Err
+}
+
+func (e *MaskingError) Cause() error {
+	return e.Err
+}
+
+/*
+ * checks the rules against the schema of db and sets the masker of each table with masked columns
+ */
+func (m *Masking) apply(ctx context.Context, db queryer, schema *Schema) error {
+	tables := make(map[string]*SchemaEntry)
+	for _, table := range schema.tables {
+		tables[strings.ToLower(table.name)] = table
+	}
+	maskers := make(map[*SchemaEntry]*rowMasker)
+	keyCols := make(map[*SchemaEntry]map[int]bool)
+	for _, rule := range m.Rules {
+		if m.Salt == "" && (rule.Method == MaskHash || rule.Method == MaskFake) {
+			return &MaskingError{Rule: rule.String(), Err: errors.New("a salt is required")}
+		}
+		table := tables[strings.ToLower(rule.Table)]
+		if table == nil {
+			return &MaskingError{Rule: rule.String(), Err: errors.New("no such table")}
+		}
+		masker := maskers[table]
+		if masker == nil {
+			tableInfo, err := getTableInfo(ctx, db, table.name)
+			if err != nil {
+				return err
+			}
+			masker = &rowMasker{salt: []byte(m.Salt), tableInfo: tableInfo, rules: make(map[int]MaskRule)}
+			maskers[table] = masker
+			keyCols[table], err = uniqueColumns(ctx, db, table.name, tableInfo)
+			if err != nil {
+				return err
+			}
+		}
+		col := -1
+		for i, ci := range masker.tableInfo.columnInfos {
+			if strings.EqualFold(ci.colName, rule.Column) {
+				col = i
+			}
+		}
+		if col < 0 {
+			return &MaskingError{Rule: rule.String(), Err: errors.New("no such column")}
+		}
+		if keyCols[table][col] && (rule.Method == MaskRedact || rule.Method == MaskTruncate) {
+			return &MaskingError{Rule: rule.String(), Err: errors.New(fmt.Sprintf("%s makes values of a PRIMARY KEY or UNIQUE column collide - use fake or hash", rule.Method))}
+		}
+		masker.rules[col] = rule
+	}
+	for table, masker := range maskers {
+		table.masker = masker
+	}
+	return nil
+}
+
+/*
+ * the columns of a table part of its primary key or of a UNIQUE index (by column index)
+ */
+func uniqueColumns(ctx context.Context, db queryer, tableName string, tableInfo *TableInfo) (map[int]bool, error) {
+	cols := make(map[int]bool)
+	for i, ci := range tableInfo.columnInfos {
+		if ci.pk > 0 {
+			cols[i] = true // an INTEGER PRIMARY KEY has no index of its own
+		}
+	}
+	rs, err := db.QueryContext(ctx, "PRAGMA index_list("+quoteIdent(tableName)+")")
+	if err != nil {
+		return nil, err
+	}
+	var indexes []string
+	for rs.Next() {
+		var seq, unique, partial int
+		var name, origin string
+		err = rs.Scan(&seq, &name, &unique, &origin, &partial)
+		if err != nil {
+			_ = rs.Close()
+			return nil, err
+		}
+		if unique != 0 {
+			indexes = append(indexes, name)
+		}
+	}
+	_ = rs.Close()
+	if err = rs.Err(); err != nil {
+		return nil, err
+	}
+	// one query after the other - db may be limited to a single connection
+	for _, index := range indexes {
+		rs, err = db.QueryContext(ctx, "PRAGMA index_info("+quoteIdent(index)+")")
+		if err != nil {
+			return nil, err
+		}
+		for rs.Next() {
+			var seqno, cid int
+			var name sql.NullString // NULL for an expression
+			err = rs.Scan(&seqno, &cid, &name)
+			if err != nil {
+				_ = rs.Close()
+				return nil, err
+			}
+			if cid >= 0 {
+				cols[cid] = true
+			}
+		}
+		_ = rs.Close()
+		if err = rs.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return cols, nil
+}
+
+/*
+ * masks the values of a table's rows as scanned by forEachRow - a nil masker keeps them
+ */
+type rowMasker struct {
+	salt      []byte
+	tableInfo *TableInfo
+	rules     map[int]MaskRule // by column index
+}
+
+func (rm *rowMasker) mask(vals []interface{}) {
+	if rm == nil {
+		return
+	}
+	for col, rule := range rm.rules {
+		vals[col] = maskValue(rule, rm.salt, vals[col])
+	}
+}
+
+// e.g. "hash", "" if the column is not masked
+func (rm *rowMasker) method(col int) string {
+	if rm == nil {
+		return ""
+	}
+	rule, ok := rm.rules[col]
+	if !ok {
+		return ""
+	}
+	if rule.Method == MaskTruncate {
+		return fmt.Sprintf("%s-%d", rule.Method, rule.Length)
+	}
+	return string(rule.Method)
+}
+
+// the rules in column order, e.g. `t1f1=hash,t1f3=truncate-4` - plus a digest of the salt
+func (rm *rowMasker) String() string {
+	if rm == nil {
+		return ""
+	}
+	cols := make([]string, 0, len(rm.rules))
+	for i, ci := range rm.tableInfo.columnInfos {
+		if method := rm.method(i); method != "" {
+			cols = append(cols, ci.colName+"="+method)
+		}
+	}
+	mac := hmac.New(sha256.New, rm.salt)
+	_, _ = mac.Write([]byte("salt"))
+	return strings.Join(cols, ",") + " " + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func maskValue(rule MaskRule, salt []byte, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	switch rule.Method {
+	case MaskRedact:
+		return redactValue(v)
+	case MaskHash:
+		return hashedValue(maskDigest(salt, "hash", v), v)
+	case MaskFake:
+		return fakeValue(&maskRand{seed: maskDigest(salt, "fake", v)}, v)
+	case MaskTruncate:
+		return truncateValue(v, rule.Length)
+	}
+	return v
+}
+
+// keyed by salt, the same value gives the same digest wherever it is stored - see hashValue
+func maskDigest(salt []byte, purpose string, v interface{}) []byte {
+	mac := hmac.New(sha256.New, salt)
+	_, _ = mac.Write([]byte(purpose))
+	hashValue(mac, v)
+	return mac.Sum(nil)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v.(type) {
+	case int64:
+		return int64(0)
+	case float64:
+		return 0.0
+	case []byte:
+		return []byte{}
+	default:
+		return maskRedactedText
+	}
+}
+
+func hashedValue(digest []byte, v interface{}) interface{} {
+	u := binary.BigEndian.Uint64(digest)
+	switch v.(type) {
+	case int64:
+		return int64(u >> 1)
+	case float64:
+		return float64(u>>11) / (1 << 53)
+	case []byte:
+		return digest
+	default:
+		return hex.EncodeToString(digest)
+	}
+}
+
+func fakeValue(r *maskRand, v interface{}) interface{} {
+	switch val := v.(type) {
+	case int64:
+		return fakeInt(r, val)
+	case float64:
+		if val == 0 || math.IsInf(val, 0) || math.IsNaN(val) {
+			return val
+		}
+		frac, exp := math.Frexp(val)
+		fake := math.Ldexp(0.5+float64(r.uint64()>>11)/(1<<54), exp) // same binary exponent
+		if frac < 0 {
+			fake = -fake
+		}
+		return fake
+	case []byte:
+		fake := make([]byte, len(val))
+		for i := range fake {
+			fake[i] = r.byte()
+		}
+		return fake
+	case string:
+		var sb strings.Builder
+		sb.Grow(len(val))
+		for _, c := range val {
+			switch {
+			case c >= '0' && c <= '9':
+				sb.WriteByte('0' + r.intn(10))
+			case unicode.IsUpper(c):
+				sb.WriteByte('A' + r.intn(26))
+			case unicode.IsLetter(c):
+				sb.WriteByte('a' + r.intn(26))
+			default:
+				sb.WriteRune(c)
+			}
+		}
+		return sb.String()
+	default:
+		return v
+	}
+}
+
+// as many digits, the sign kept - a leading zero only for 0 itself
+func fakeInt(r *maskRand, v int64) int64 {
+	digits := len(strconv.FormatUint(absInt(v), 10))
+	if digits == 1 {
+		return intSign(v) * int64(r.intn(10))
+	}
+	// 19 digits may exceed math.MaxInt64 - unless led by 1..8
+	first := 9
+	if digits == 19 {
+		first = 8
+	}
+	fake := int64(1 + r.intn(byte(first)))
+	for i := 1; i < digits; i++ {
+		fake = fake*10 + int64(r.intn(10))
+	}
+	return intSign(v) * fake
+}
+
+func absInt(v int64) uint64 {
+	if v < 0 {
+		return uint64(-(v + 1)) + 1 // math.MinInt64 as well
+	}
+	return uint64(v)
+}
+
+func intSign(v int64) int64 {
+	if v < 0 {
+		return -1
+	}
+	return 1
+}
+
+func truncateValue(v interface{}, length int) interface{} {
+	switch val := v.(type) {
+	case string:
+		if utf8.RuneCountInString(val) <= length {
+			return val
+		}
+		return string([]rune(val)[:length])
+	case []byte:
+		if len(val) <= length {
+			return val
+		}
+		return val[:length]
+	default:
+		return v
+	}
+}
+
+/*
+ * a deterministic byte stream: sha256(seed, counter) block by block
+ */
+type maskRand struct {
+	seed    []byte
+	block   []byte
+	counter uint64
+}
+
+func (r *maskRand) byte() byte {
+	if len(r.block) == 0 {
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], r.counter)
+		r.counter++
+		sum := sha256.Sum256(append(append([]byte(nil), r.seed...), buf[:]...))
+		r.block = sum[:]
+	}
+	b := r.block[0]
+	r.block = r.block[1:]
+	return b
+}
+
+// uniform in [0, n) - rejects the biased top of the byte range
+func (r *maskRand) intn(n byte) byte {
+	limit := 256 - 256%int(n)
+	for {
+		if b := r.byte(); int(b) < limit {
+			return b % n
+		}
+	}
+}
+
+func (r *maskRand) uint64() uint64 {
+	var buf [8]byte
+	for i := range buf {
+		buf[i] = r.byte()
+	}
+	return binary.BigEndian.Uint64(buf[:])
+}
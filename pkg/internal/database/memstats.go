@@ -0,0 +1,31 @@
+package database
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+ * resident set size of this process in bytes - the figure the memory growth is observed on. -1 where /proc is not
+ * available (e.g. windows, where the test harness measures with `tasklist` instead)
+ */
+func processRss() int64 {
+	statm, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return -1
+	}
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return -1
+	}
+	residentPages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return residentPages * int64(os.Getpagesize())
+}
+
+func ProcessRss() int64 {
+	return processRss()
+}
@@ -0,0 +1,198 @@
+package database
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+/*
+ * the connections of a parallel FormatSql dump (see ActivityOptions.DumpWorkers) - nil when the dump runs sequentially,
+ * e.g. as the snapshot is private to its connection. the returned func closes them.
+ */
+func openDumpReaders(snap *Snapshot, opts *ActivityOptions, res *ActivityResult) (*sql.DB, func()) {
+	res.DumpWorkers = 1
+	noop := func() {}
+	if opts.DumpWorkers <= 1 || opts.Format != FormatSql {
+		return nil, noop
+	}
+	readers, err := snap.openReaders(opts.DumpWorkers)
+	if err != nil {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db dump: cannot open reader connections, dumping sequentially - err: %+v", err) + "\n")
+		return nil, noop
+	}
+	if readers == nil {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db dump: snapshot (strategy %s, copy method %s) not readable by further connections, dumping sequentially", snap.Strategy().Name(), snap.CopyMethod()) + "\n")
+		return nil, noop
+	}
+	res.DumpWorkers = opts.DumpWorkers
+	return readers, func() {
+		err := snap.closeReaders(readers)
+		if err != nil {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db dump: failed to close reader connections - err: %+v", err) + "\n")
+		}
+	}
+}
+
+/*
+ * the data of one table of a parallel dump - its INSERTs without intermediate COMMITs, those are placed when appending
+ * the part to the dump (see appendPart)
+ */
+type tablePart struct {
+	file     string
+	stmts    int
+	stmtLens []int // recorded if the dump commits every n statements
+	err      error
+	done     chan struct{}
+}
+
+/*
+ * like the sequential loop of alternativeDump, but dumps as many tables at a time as readers has connections: each
+ * table goes to a temp file first, which are appended to iw in table order - so the dump is the same byte by byte.
+ */
+func dumpTablesParallel(ctx context.Context, readers *sql.DB, tables []*SchemaEntry, iw *insWriter, progress ProgressFunc) error {
+	ctx, cancel := context.WithCancel(ctx)
+	parts := make([]*tablePart, len(tables))
+	for i := range parts {
+		parts[i] = &tablePart{done: make(chan struct{})}
+	}
+	var failedMu sync.Mutex
+	var failed error // first error of a worker
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+		for _, part := range parts {
+			if part.file != "" {
+				_ = tempSpace.removeTemp(part.file)
+			}
+		}
+	}()
+
+	go func() {
+		defer close(next)
+		for i := range tables {
+			select {
+			case next <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	progress = progress.synchronized()
+	for w := 0; w < readers.Stats().MaxOpenConnections; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				part := parts[i]
+				part.err = dumpTablePart(ctx, readers, tables[i], part, iw.opts, progress)
+				if part.err != nil {
+					failedMu.Lock()
+					if failed == nil {
+						failed = part.err
+					}
+					failedMu.Unlock()
+					cancel()
+				}
+				close(part.done)
+			}
+		}()
+	}
+
+	for _, part := range parts {
+		select {
+		case <-part.done:
+		case <-ctx.Done():
+		}
+		failedMu.Lock()
+		err := failed
+		failedMu.Unlock()
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+		err = iw.appendPart(part)
+		if err != nil {
+			return err
+		}
+		_ = tempSpace.removeTemp(part.file)
+		part.file = ""
+	}
+	return nil
+}
+
+func dumpTablePart(ctx context.Context, readers *sql.DB, table *SchemaEntry, part *tablePart, opts SqlDumpOptions, progress ProgressFunc) error {
+	file, err := tempSpace.createTemp(".export-*.sql")
+	if err != nil {
+		return err
+	}
+	part.file = file.Name()
+
+	bw := bufio.NewWriterSize(file, 1<<16)
+	pw := &insWriter{file: bw, opts: opts, recordLens: opts.CommitEvery > 0}
+	pw.opts.CommitEvery = 0
+	err = dumpTableData(ctx, readers, table, pw, progress)
+	if err == nil {
+		err = bw.Flush()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	part.stmts = pw.stmts
+	part.stmtLens = pw.stmtLens
+	return err
+}
+
+/*
+ * a part is whatever precedes the first statement (the DELETE of sqlite_sequence) followed by its statements
+ */
+func (iw *insWriter) appendPart(part *tablePart) error {
+	file, err := os.Open(part.file)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if iw.opts.CommitEvery <= 0 {
+		_, err = io.Copy(iw.file, file)
+		failOnErr("write insStmts", err)
+		iw.stmts += part.stmts
+		return nil
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	stmtBytes := int64(0)
+	for _, l := range part.stmtLens {
+		stmtBytes += int64(l)
+	}
+	br := bufio.NewReaderSize(file, 1<<16)
+	_, err = io.CopyN(iw.file, br, info.Size()-stmtBytes)
+	failOnErr("write insStmts", err)
+	var buf []byte
+	for _, l := range part.stmtLens {
+		if cap(buf) < l {
+			buf = make([]byte, l)
+		}
+		_, err = io.ReadFull(br, buf[:l])
+		if err != nil {
+			return err
+		}
+		_, err = iw.file.Write(buf[:l])
+		failOnErr("write insStmts", err)
+		iw.stmtWritten()
+	}
+	return nil
+}
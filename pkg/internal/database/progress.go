@@ -0,0 +1,83 @@
+package database
+
+import (
+	"fmt"
+	"sync"
+)
+
+const ProgressSnapshot = "snapshot"
+const ProgressDump = "dump"
+const ProgressRestore = "restore"
+
+// granularity of progress events - keeps the number of events per iteration small enough to be sampled by the harness
+const progressSnapshotPercentStep = 10
+const progressDumpRowStep = 500000
+const progressRestoreStmtStep = 500000
+
+/*
+ * a progress event of an activity:
+ * - snapshot: pages copied/remaining as reported by the backup object (a serialized snapshot reports only once, done)
+ * - dump: rows written for the table currently dumped
+ * - restore: statements executed (as Rows) up to Line of the dump
+ */
+type Progress struct {
+	Phase          string
+	PagesCopied    int
+	PagesRemaining int
+	Table          string
+	Rows           int64
+	Line           int
+	Done           bool // the snapshot resp. the dump of Table resp. the restore is complete
+}
+
+type ProgressFunc func(p Progress)
+
+func (p Progress) String() string {
+	if p.Phase == ProgressSnapshot {
+		return fmt.Sprintf("%s pages=%d remaining=%d done=%t", p.Phase, p.PagesCopied, p.PagesRemaining, p.Done)
+	}
+	if p.Phase == ProgressRestore {
+		return fmt.Sprintf("%s statements=%d line=%d done=%t", p.Phase, p.Rows, p.Line, p.Done)
+	}
+	return fmt.Sprintf("%s table=%s rows=%d done=%t", p.Phase, p.Table, p.Rows, p.Done)
+}
+
+func (f ProgressFunc) report(p Progress) {
+	if f != nil {
+		f(p)
+	}
+}
+
+// f called by one goroutine at a time - e.g. by the workers of a parallel dump
+func (f ProgressFunc) synchronized() ProgressFunc {
+	if f == nil {
+		return nil
+	}
+	var mu sync.Mutex
+	return func(p Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+		f(p)
+	}
+}
+
+/*
+ * reports the snapshot progress whenever another progressSnapshotPercentStep percent of the pages got copied
+ */
+type snapshotProgress struct {
+	progress    ProgressFunc
+	lastPercent int
+}
+
+func (sp *snapshotProgress) step(pageCount int, remaining int, done bool) {
+	copied := pageCount - remaining
+	percent := 100
+	if pageCount > 0 {
+		percent = copied * 100 / pageCount
+	}
+	if !done && percent < sp.lastPercent+progressSnapshotPercentStep {
+		return
+	}
+	sp.lastPercent = percent
+	sp.progress.report(Progress{Phase: ProgressSnapshot, PagesCopied: copied, PagesRemaining: remaining, Done: done})
+}
@@ -0,0 +1,106 @@
+package database
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSnapshotProgressStep(t *testing.T) {
+	var events []Progress
+	sp := &snapshotProgress{progress: func(p Progress) { events = append(events, p) }}
+	for remaining := 99; remaining >= 0; remaining-- {
+		sp.step(100, remaining, false)
+	}
+	sp.step(100, 0, true)
+	if len(events) != 11 {
+		t.Fatalf("got %d events, want one per %d%% and the done one: %v", len(events), progressSnapshotPercentStep, events)
+	}
+	for i, p := range events[:10] {
+		if p.Phase != ProgressSnapshot || p.PagesCopied != (i+1)*10 || p.PagesRemaining != 100-p.PagesCopied || p.Done {
+			t.Errorf("event %d: %s", i, p)
+		}
+	}
+	if last := events[10]; last.PagesCopied != 100 || last.PagesRemaining != 0 || !last.Done {
+		t.Errorf("last event: %s", last)
+	}
+
+	// done is reported regardless of the step
+	events = nil
+	sp = &snapshotProgress{progress: func(p Progress) { events = append(events, p) }}
+	sp.step(100, 95, false)
+	sp.step(100, 93, true)
+	if len(events) != 1 || !events[0].Done || events[0].PagesCopied != 7 {
+		t.Errorf("got %v, want the done event only", events)
+	}
+	(&snapshotProgress{}).step(100, 0, true) // no ProgressFunc
+}
+
+/*
+ * the events of a dump: the snapshot ones with increasing pages and finally done, then each table's with increasing
+ * rows and finally done - tables may interleave when dumped in parallel
+ */
+func TestActivityProgress(t *testing.T) {
+	ctx := context.Background()
+	tables, err := queryStrings(ctx, MyDb, "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		copyMethod SnapshotCopyMethod
+		workers    int
+	}{
+		{CopyBackup, 1},
+		{CopyBackup, 4},
+		{CopySerializeGoManaged, 1},
+		{CopySerializeSqliteManaged, 1},
+		{CopyVacuumInto, 1},
+	} {
+		var events []Progress
+		opts := DefaultActivityOptions()
+		opts.Strategy = StrategyTempFile
+		opts.CopyMethod = tc.copyMethod
+		opts.Stepping = StepPolicy{Pages: 1}
+		opts.DumpWorkers = tc.workers
+		opts.Progress = func(p Progress) { events = append(events, p) }
+		_, err := Activity(ctx, ActivityDump, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var snapshotEvents []Progress
+		for len(events) > 0 && events[0].Phase == ProgressSnapshot {
+			snapshotEvents, events = append(snapshotEvents, events[0]), events[1:]
+		}
+		if len(snapshotEvents) == 0 || !snapshotEvents[len(snapshotEvents)-1].Done {
+			t.Errorf("%s: snapshot events %v not ending done", tc.copyMethod, snapshotEvents)
+		} else if tc.copyMethod != CopyBackup && len(snapshotEvents) != 1 {
+			t.Errorf("%s: snapshot events %v, want the done one only", tc.copyMethod, snapshotEvents)
+		}
+		for i, p := range snapshotEvents {
+			if i > 0 && (p.PagesCopied <= snapshotEvents[i-1].PagesCopied || snapshotEvents[i-1].Done) {
+				t.Errorf("%s: snapshot event %s after %s", tc.copyMethod, p, snapshotEvents[i-1])
+			}
+		}
+
+		done := make(map[string]bool)
+		rows := make(map[string]int64)
+		for _, p := range events {
+			if p.Phase != ProgressDump {
+				t.Errorf("%s: %s after the snapshot", tc.copyMethod, p)
+				continue
+			}
+			if done[p.Table] || p.Rows < rows[p.Table] {
+				t.Errorf("%s: %s after rows=%d done=%t", tc.copyMethod, p, rows[p.Table], done[p.Table])
+			}
+			done[p.Table], rows[p.Table] = p.Done, p.Rows
+		}
+		for _, table := range tables {
+			if !done[table] {
+				t.Errorf("%s: dump of %s not reported done", tc.copyMethod, table)
+			}
+		}
+		if len(done) != len(tables) {
+			t.Errorf("%s: dump events of %d tables, want %d", tc.copyMethod, len(done), len(tables))
+		}
+	}
+}
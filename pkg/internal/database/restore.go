@@ -0,0 +1,418 @@
+package database
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"gopkg.in/errgo.v2/errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const DefaultRestoreBatchSize = 10000
+
+type RestoreOptions struct {
+	BatchSize int // statements per transaction
+	Progress  ProgressFunc
+}
+
+type RestoreResult struct {
+	Statements           int64
+	Transactions         int
+	Lines                int
+	ForeignKeyViolations int // found after the restore - the dump itself turns checking off
+	Duration             time.Duration
+}
+
+func (r *RestoreResult) String() string {
+	return fmt.Sprintf("statements=%d transactions=%d lines=%d fkViolations=%d total=%s",
+		r.Statements, r.Transactions, r.Lines, r.ForeignKeyViolations, r.Duration.Round(time.Millisecond))
+}
+
+/*
+ * a statement of the dump failed (or could not be parsed) - Line is where it starts
+ */
+type RestoreError struct {
+	Line int
+	Stmt string
+	Err  error
+}
+
+func (e *RestoreError) Error() string {
+	stmt := e.Stmt
+	if len(stmt) > 200 {
+		stmt = stmt[:200] + "..."
+	}
+	return fmt.Sprintf("restore failed at line %d: %v - stmt: %s", e.Line, e.Err, stmt)
+}
+
+func (e *RestoreError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RestoreError) Cause() error {
+	return e.Err
+}
+
+/*
+ * replays a dump - gzip compressed or plain sql - against db, which may be empty or already contain data.
+ * statements run in transactions of opts.BatchSize, the dump's own BEGIN/COMMIT are dropped for that. PRAGMAs run
+ * between transactions, as e.g. foreign_keys cannot change within one. foreign key enforcement is set back to what it
+ * was before and the restored data is checked once at the end.
+ * NOTE: on failure, batches committed so far remain
+ */
+func Restore(ctx context.Context, db *sql.DB, r io.Reader, opts *RestoreOptions) (*RestoreResult, error) {
+	start := time.Now()
+	res := &RestoreResult{}
+	defer func() {
+		res.Duration = time.Since(start)
+	}()
+
+	batchSize := DefaultRestoreBatchSize
+	var progress ProgressFunc
+	if opts != nil {
+		if opts.BatchSize > 0 {
+			batchSize = opts.BatchSize
+		}
+		progress = opts.Progress
+	}
+
+	br := bufio.NewReaderSize(r, 1<<16)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return res, err
+		}
+		defer gr.Close()
+		br = bufio.NewReaderSize(gr, 1<<16)
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return res, err
+	}
+	defer conn.Close()
+
+	fkBefore, err := queryStrings(ctx, conn, "PRAGMA foreign_keys")
+	if err != nil {
+		return res, err
+	}
+	defer func() {
+		if len(fkBefore) == 1 {
+			_, _ = conn.ExecContext(context.Background(), "PRAGMA foreign_keys="+fkBefore[0])
+		}
+	}()
+
+	rs := &restorer{ctx: ctx, conn: conn, res: res, batchSize: batchSize, progress: progress}
+	splitter := newStmtSplitter(br)
+	for {
+		stmt, line, err := splitter.next()
+		res.Lines = splitter.line
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			rs.rollback()
+			return res, &RestoreError{Line: line, Stmt: stmt, Err: err}
+		}
+		err = rs.exec(stmt)
+		if err != nil {
+			rs.rollback()
+			if cErr := cancelledErr(ctx, err); cErr != nil {
+				return res, cErr
+			}
+			return res, &RestoreError{Line: line, Stmt: stmt, Err: err}
+		}
+	}
+	err = rs.commit()
+	if err != nil {
+		return res, err
+	}
+	progress.report(Progress{Phase: ProgressRestore, Rows: res.Statements, Line: res.Lines, Done: true})
+
+	violations, err := foreignKeyViolations(ctx, conn)
+	if err != nil {
+		return res, err
+	}
+	res.ForeignKeyViolations = len(violations)
+	return res, nil
+}
+
+type restorer struct {
+	ctx       context.Context
+	conn      *sql.Conn
+	tx        *sql.Tx
+	inTx      int
+	res       *RestoreResult
+	batchSize int
+	progress  ProgressFunc
+}
+
+func (rs *restorer) exec(stmt string) error {
+	keyword := strings.ToUpper(firstWord(stmt))
+	switch keyword {
+	case "BEGIN", "COMMIT", "END", "ROLLBACK":
+		// transactions are up to the restorer
+		return nil
+	case "PRAGMA":
+		err := rs.commit()
+		if err != nil {
+			return err
+		}
+		_, err = rs.conn.ExecContext(rs.ctx, stmt)
+		rs.counted()
+		return err
+	}
+
+	if rs.tx == nil {
+		var err error
+		rs.tx, err = rs.conn.BeginTx(rs.ctx, nil)
+		if err != nil {
+			return err
+		}
+		rs.res.Transactions++
+	}
+	_, err := rs.tx.ExecContext(rs.ctx, stmt)
+	if err != nil {
+		return err
+	}
+	rs.counted()
+	rs.inTx++
+	if rs.inTx >= rs.batchSize {
+		return rs.commit()
+	}
+	return nil
+}
+
+func (rs *restorer) counted() {
+	rs.res.Statements++
+	if rs.res.Statements%progressRestoreStmtStep == 0 {
+		rs.progress.report(Progress{Phase: ProgressRestore, Rows: rs.res.Statements, Line: rs.res.Lines})
+	}
+}
+
+func (rs *restorer) commit() error {
+	if rs.tx == nil {
+		return nil
+	}
+	err := rs.tx.Commit()
+	rs.tx = nil
+	rs.inTx = 0
+	return err
+}
+
+func (rs *restorer) rollback() {
+	if rs.tx != nil {
+		_ = rs.tx.Rollback()
+		rs.tx = nil
+		rs.inTx = 0
+	}
+}
+
+func firstWord(stmt string) string {
+	end := strings.IndexFunc(stmt, func(r rune) bool { return !isWordChar(r) })
+	if end < 0 {
+		return stmt
+	}
+	return stmt[:end]
+}
+
+func isWordChar(r rune) bool {
+	return r == '_' || r == '$' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= 0x80
+}
+
+/*
+ * splits sql text into statements at `;` - not within quotes ('..', "..", `..`, [..]), comments or a trigger body.
+ * like sqlite3_complete(), a trigger ends at `END;` only.
+ */
+type stmtSplitter struct {
+	r    *bufio.Reader
+	line int // of the last byte read, 1-based
+}
+
+func newStmtSplitter(r *bufio.Reader) *stmtSplitter {
+	return &stmtSplitter{r: r, line: 1}
+}
+
+/*
+ * returns the next statement (without the terminating `;`) and the line it starts at, io.EOF after the last one.
+ * a statement missing its final `;` at the end of input is still returned, an unterminated quote or comment is an
+ * error. comments in front of a statement are dropped, those within kept.
+ */
+func (s *stmtSplitter) next() (string, int, error) {
+	var sb strings.Builder
+	startLine := 0 // 0: no content yet
+	var word strings.Builder
+	words := make([]string, 0, 3) // leading words, to recognize CREATE [TEMP] TRIGGER
+	lastWord := ""
+	trigger := false
+
+	endWord := func() {
+		if word.Len() == 0 {
+			return
+		}
+		lastWord = strings.ToUpper(word.String())
+		word.Reset()
+		if len(words) < 3 {
+			words = append(words, lastWord)
+			trigger = len(words) >= 2 && words[0] == "CREATE" &&
+				(words[1] == "TRIGGER" || len(words) == 3 && (words[1] == "TEMP" || words[1] == "TEMPORARY") && words[2] == "TRIGGER")
+		}
+	}
+
+	for {
+		c, err := s.r.ReadByte()
+		if err == io.EOF {
+			if startLine == 0 {
+				return "", s.line, io.EOF
+			}
+			return strings.TrimSpace(sb.String()), startLine, nil
+		}
+		if err != nil {
+			return sb.String(), startLine, err
+		}
+
+		if isWordChar(rune(c)) {
+			if startLine == 0 {
+				startLine = s.line
+			}
+			word.WriteByte(c)
+			sb.WriteByte(c)
+			continue
+		}
+		endWord()
+
+		switch c {
+		case '\n', ' ', '\t', '\r', '\f':
+			if c == '\n' {
+				s.line++
+			}
+			if startLine != 0 {
+				sb.WriteByte(c)
+			}
+			continue
+		case '-', '/':
+			next, err := s.r.Peek(1)
+			if err == nil && (c == '-' && next[0] == '-' || c == '/' && next[0] == '*') {
+				second, _ := s.r.ReadByte()
+				commentLine := s.line
+				var comment strings.Builder
+				comment.WriteByte(c)
+				comment.WriteByte(second)
+				err = s.comment(&comment, c)
+				if err != nil {
+					return comment.String(), commentLine, err
+				}
+				if startLine != 0 {
+					sb.WriteString(comment.String())
+				}
+				continue
+			}
+		}
+
+		if startLine == 0 {
+			startLine = s.line
+		}
+		switch c {
+		case ';':
+			if strings.TrimSpace(sb.String()) == "" {
+				// an empty statement
+				startLine = 0
+				continue
+			}
+			if !trigger || lastWord == "END" {
+				return strings.TrimSpace(sb.String()), startLine, nil
+			}
+			sb.WriteByte(c)
+			lastWord = ""
+		case '\'', '"', '`', '[':
+			sb.WriteByte(c)
+			err = s.quoted(&sb, c)
+			if err != nil {
+				return sb.String(), startLine, err
+			}
+			lastWord = ""
+		default:
+			sb.WriteByte(c)
+		}
+	}
+}
+
+func (s *stmtSplitter) quoted(sb *strings.Builder, open byte) error {
+	closing := open
+	if open == '[' {
+		closing = ']'
+	}
+	for {
+		c, err := s.r.ReadByte()
+		if err == io.EOF {
+			return errors.New(fmt.Sprintf("unterminated %c", open))
+		}
+		if err != nil {
+			return err
+		}
+		if c == '\n' {
+			s.line++
+		}
+		sb.WriteByte(c)
+		if c != closing {
+			continue
+		}
+		// a doubled quote is an escaped one - not so for ]
+		next, err := s.r.Peek(1)
+		if closing != ']' && err == nil && next[0] == closing {
+			_, _ = s.r.ReadByte()
+			sb.WriteByte(closing)
+			continue
+		}
+		return nil
+	}
+}
+
+/*
+ * the rest of a `--` resp. `/*` comment, its opening already consumed
+ */
+func (s *stmtSplitter) comment(sb *strings.Builder, open byte) error {
+	prev := byte(0)
+	for {
+		c, err := s.r.ReadByte()
+		if err == io.EOF {
+			if open == '-' {
+				return nil
+			}
+			return errors.New("unterminated comment")
+		}
+		if err != nil {
+			return err
+		}
+		if c == '\n' {
+			s.line++
+		}
+		sb.WriteByte(c)
+		if open == '-' && c == '\n' || open == '/' && prev == '*' && c == '/' {
+			return nil
+		}
+		prev = c
+	}
+}
+
+/*
+ * restores a dump file (resp. the dumps of a chain manifest, see RestoreChain) into a sqlite db file - created if it
+ * does not exist yet
+ */
+func RestoreFile(ctx context.Context, dumpFile string, dbFile string, opts *RestoreOptions) (*RestoreResult, error) {
+	if _, err := os.Stat(dumpFile); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=rwc&_fk=1", dbFile))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return restoreFile(ctx, db, dumpFile, opts)
+}
@@ -0,0 +1,161 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"gopkg.in/errgo.v2/errors"
+	"os"
+	"time"
+)
+
+/*
+ * snapshotting is non-invasive: the backup api releases the source db between page chunks, so concurrent requests may
+ * lock or change it in the meantime. such failures are transient and the snapshot is simply retried according to a
+ * RetryPolicy, while any other failure is given up on immediately.
+ */
+type RetryPolicy struct {
+	MaxAttempts    int           // total number of attempts incl. the first one, values < 1 are treated as 1
+	InitialBackoff time.Duration // wait before the 2nd attempt
+	MaxBackoff     time.Duration // upper limit for the wait between two attempts, 0 = unlimited
+	Multiplier     float64       // backoff growth per attempt, values < 1 are treated as 1
+	Deadline       time.Duration // overall time budget for all attempts incl. backoff, 0 = unlimited
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	Multiplier:     2,
+	Deadline:       2 * time.Minute,
+}
+
+// the source db changed between two chunks, so the backup had to start over
+var ErrSnapshotSourceModified = errors.New("snapshot source db modified during backup")
+
+type snapshotErrClass int
+
+const (
+	snapshotErrFatal snapshotErrClass = iota
+	snapshotErrBusy
+	snapshotErrLocked
+	snapshotErrSourceModified
+)
+
+func (c snapshotErrClass) String() string {
+	switch c {
+	case snapshotErrBusy:
+		return "busy"
+	case snapshotErrLocked:
+		return "locked"
+	case snapshotErrSourceModified:
+		return "source modified"
+	default:
+		return "fatal"
+	}
+}
+
+func (c snapshotErrClass) retryable() bool {
+	return c != snapshotErrFatal
+}
+
+func classifySnapshotErr(err error) snapshotErrClass {
+	cause := errors.Cause(err)
+	if cause == ErrSnapshotSourceModified {
+		return snapshotErrSourceModified
+	}
+	var sqliteErr sqlite3.Error
+	switch e := cause.(type) {
+	case sqlite3.Error:
+		sqliteErr = e
+	case *sqlite3.Error:
+		sqliteErr = *e
+	default:
+		return snapshotErrFatal
+	}
+	switch sqliteErr.Code {
+	case sqlite3.ErrBusy:
+		return snapshotErrBusy
+	case sqlite3.ErrLocked:
+		return snapshotErrLocked
+	default:
+		return snapshotErrFatal
+	}
+}
+
+/*
+ * returned when a snapshot could not be created - either due to a non transient error or because the retry policy
+ * was exhausted
+ */
+type SnapshotError struct {
+	Attempts int
+	Elapsed  time.Duration
+	Reason   string // "fatal", "max attempts", "deadline" or "cancelled"
+	Err      error  // last error encountered
+}
+
+func (e *SnapshotError) Error() string {
+	return fmt.Sprintf("db snapshot failed after %d attempt(s) in %s (%s): %v", e.Attempts, e.Elapsed.Round(time.Millisecond), e.Reason, e.Err)
+}
+
+func (e *SnapshotError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SnapshotError) Cause() error {
+	return e.Err
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	wait := float64(p.InitialBackoff)
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	for i := 1; i < attempt; i++ {
+		wait *= multiplier
+		if p.MaxBackoff > 0 && wait > float64(p.MaxBackoff) {
+			return p.MaxBackoff
+		}
+	}
+	return time.Duration(wait)
+}
+
+/*
+ * runs `attempt` until it succeeds, fails with a non retryable error, the policy is exhausted or ctx is done
+ */
+func (p RetryPolicy) run(ctx context.Context, attempt func(nr int) error) error {
+	maxAttempts := p.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	start := time.Now()
+	for nr := 1; ; nr++ {
+		err := attempt(nr)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return &SnapshotError{Attempts: nr, Elapsed: time.Since(start), Reason: "cancelled", Err: ctx.Err()}
+		}
+
+		class := classifySnapshotErr(err)
+		if !class.retryable() {
+			return &SnapshotError{Attempts: nr, Elapsed: time.Since(start), Reason: "fatal", Err: err}
+		}
+		if nr >= maxAttempts {
+			return &SnapshotError{Attempts: nr, Elapsed: time.Since(start), Reason: "max attempts", Err: err}
+		}
+
+		wait := p.backoff(nr)
+		if p.Deadline > 0 && time.Since(start)+wait >= p.Deadline {
+			return &SnapshotError{Attempts: nr, Elapsed: time.Since(start), Reason: "deadline", Err: err}
+		}
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: attempt %d failed (%s), retrying in %s - err: %+v", nr, class, wait, err) + "\n")
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return &SnapshotError{Attempts: nr, Elapsed: time.Since(start), Reason: "cancelled", Err: ctx.Err()}
+		}
+	}
+}
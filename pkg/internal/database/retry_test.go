@@ -0,0 +1,100 @@
+package database
+
+import (
+	"context"
+	"github.com/mattn/go-sqlite3"
+	"gopkg.in/errgo.v2/errors"
+	"testing"
+	"time"
+)
+
+func TestClassifySnapshotErr(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want snapshotErrClass
+	}{
+		{"busy", sqlite3.Error{Code: sqlite3.ErrBusy}, snapshotErrBusy},
+		{"busy pointer", &sqlite3.Error{Code: sqlite3.ErrBusy}, snapshotErrBusy},
+		{"locked", sqlite3.Error{Code: sqlite3.ErrLocked}, snapshotErrLocked},
+		{"locked wrapped", errors.Because(sqlite3.Error{Code: sqlite3.ErrLocked}, sqlite3.Error{Code: sqlite3.ErrLocked}, "backup step"), snapshotErrLocked},
+		{"source modified", ErrSnapshotSourceModified, snapshotErrSourceModified},
+		{"source modified wrapped", errors.Because(ErrSnapshotSourceModified, ErrSnapshotSourceModified, "backup step"), snapshotErrSourceModified},
+		{"other sqlite error", sqlite3.Error{Code: sqlite3.ErrCorrupt}, snapshotErrFatal},
+		{"other error", errors.New("boom"), snapshotErrFatal},
+	} {
+		if got := classifySnapshotErr(tc.err); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{"first", RetryPolicy{InitialBackoff: 100 * time.Millisecond, Multiplier: 2}, 1, 100 * time.Millisecond},
+		{"grows", RetryPolicy{InitialBackoff: 100 * time.Millisecond, Multiplier: 2}, 4, 800 * time.Millisecond},
+		{"capped", RetryPolicy{InitialBackoff: 100 * time.Millisecond, Multiplier: 2, MaxBackoff: 300 * time.Millisecond}, 4, 300 * time.Millisecond},
+		{"unlimited", RetryPolicy{InitialBackoff: time.Second, Multiplier: 10}, 3, 100 * time.Second},
+		{"multiplier < 1 is constant", RetryPolicy{InitialBackoff: 100 * time.Millisecond, Multiplier: 0.5}, 5, 100 * time.Millisecond},
+	} {
+		if got := tc.policy.backoff(tc.attempt); got != tc.want {
+			t.Errorf("%s: backoff(%d) = %s, want %s", tc.name, tc.attempt, got, tc.want)
+		}
+	}
+}
+
+func TestRetryPolicyRun(t *testing.T) {
+	busy := sqlite3.Error{Code: sqlite3.ErrBusy}
+	for _, tc := range []struct {
+		name         string
+		policy       RetryPolicy
+		failures     int // attempts failing with busy before one succeeds
+		fatal        bool
+		wantAttempts int
+		wantReason   string // "" for success
+	}{
+		{"first attempt", RetryPolicy{MaxAttempts: 3}, 0, false, 1, ""},
+		{"retried", RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}, 2, false, 3, ""},
+		{"max attempts", RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}, 5, false, 3, "max attempts"},
+		{"no attempts is one", RetryPolicy{}, 5, false, 1, "max attempts"},
+		{"fatal", RetryPolicy{MaxAttempts: 3}, 0, true, 1, "fatal"},
+		{"deadline", RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Second, Deadline: 500 * time.Millisecond}, 5, false, 1, "deadline"},
+	} {
+		attempts := 0
+		err := tc.policy.run(context.Background(), func(nr int) error {
+			attempts = nr
+			if tc.fatal {
+				return errors.New("boom")
+			}
+			if nr <= tc.failures {
+				return busy
+			}
+			return nil
+		})
+		if attempts != tc.wantAttempts {
+			t.Errorf("%s: %d attempts, want %d", tc.name, attempts, tc.wantAttempts)
+		}
+		if tc.wantReason == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+			}
+			continue
+		}
+		snapErr, ok := err.(*SnapshotError)
+		if !ok || snapErr.Reason != tc.wantReason || snapErr.Attempts != tc.wantAttempts {
+			t.Errorf("%s: got %v, want a *SnapshotError (%s) after %d attempt(s)", tc.name, err, tc.wantReason, tc.wantAttempts)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := RetryPolicy{MaxAttempts: 3}.run(ctx, func(int) error { return busy })
+	if snapErr, ok := err.(*SnapshotError); !ok || snapErr.Reason != "cancelled" {
+		t.Errorf("cancelled: got %v", err)
+	}
+}
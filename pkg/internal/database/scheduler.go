@@ -0,0 +1,281 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/errgo.v2/errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const OriginCommand = "command"
+const OriginScheduler = "scheduler"
+const OriginHttp = "http"
+
+/*
+ * the outcome of one activity run - command loop and scheduler report through the same channel of these
+ */
+type ActivityOutcome struct {
+	Origin  string
+	Cmd     string
+	At      time.Time
+	Result  *ActivityResult // nil if skipped
+	Err     error
+	Skipped bool // a scheduled run was skipped, as the previous one was still running
+}
+
+func (o ActivityOutcome) String() string {
+	if o.Skipped {
+		return fmt.Sprintf("%s %s skipped - previous run still in progress", o.Origin, o.Cmd)
+	}
+	s := fmt.Sprintf("%s %s: %s", o.Origin, o.Cmd, o.Result)
+	if o.Err != nil {
+		s += fmt.Sprintf(" err: %v", o.Err)
+	}
+	return s
+}
+
+/*
+ * when to run next - see ParseSchedule
+ */
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+/*
+ * accepts
+ * - `@every <duration>`, e.g. `@every 10m`
+ * - a 5 field cron spec `minute hour day-of-month month day-of-week`, each field being `*`, a number, a range `a-b`,
+ *   a stepped range `a-b/n` (`*` as range allowed) or a comma separated list of these, e.g. `0-59/15 * * * *` or
+ *   `0 2 * * 1-5`. unlike classic cron, a time has to match all fields - also both day fields.
+ */
+func ParseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil || d <= 0 {
+			return nil, errors.New(fmt.Sprintf("invalid schedule %q - expected a positive duration", spec))
+		}
+		return everySchedule(d), nil
+	}
+	return parseCronSchedule(spec)
+}
+
+type everySchedule time.Duration
+
+func (e everySchedule) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(e))
+}
+
+type cronSchedule struct {
+	minutes, hours, daysOfMonth, months, daysOfWeek map[int]bool
+}
+
+var cronFieldRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+func parseCronSchedule(spec string) (Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.New(fmt.Sprintf("invalid schedule %q - expected `@every <duration>` or 5 cron fields", spec))
+	}
+	sets := make([]map[int]bool, 5)
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFieldRanges[i][0], cronFieldRanges[i][1])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid schedule %q: %v", spec, err))
+		}
+		sets[i] = set
+	}
+	return &cronSchedule{sets[0], sets[1], sets[2], sets[3], sets[4]}, nil
+}
+
+func parseCronField(field string, min int, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return nil, errors.New(fmt.Sprintf("invalid step in %q", part))
+			}
+			rangePart = part[:i]
+		}
+		from, to := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			from, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid value in %q", part))
+			}
+			to = from
+			if len(bounds) == 2 {
+				to, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, errors.New(fmt.Sprintf("invalid range in %q", part))
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, errors.New(fmt.Sprintf("%q out of range %d-%d", part, min, max))
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSchedule) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	// every combination repeats within 4 years (leap years) - give up after that
+	limit := t.AddDate(4, 0, 1)
+	for t.Before(limit) {
+		if c.months[int(t.Month())] && c.daysOfMonth[t.Day()] && c.daysOfWeek[int(t.Weekday())] &&
+			c.hours[t.Hour()] && c.minutes[t.Minute()] {
+			return t
+		}
+		t = t.Add(time.Minute)
+	}
+	return time.Time{}
+}
+
+/*
+ * what the scheduler runs - KeepDumps > 0 limits the number of dump files the scheduler wrote that are kept (oldest
+ * deleted first). a chain (see ActivityOptions.Chain) counts as one dump and is deleted as a whole - manifest, dumps
+ * and state - once it is not continued anymore. dumps of other origins, e.g. of the `DUMP` command, are left alone.
+ */
+type SchedulerConfig struct {
+	Schedule  Schedule
+	Cmd       string
+	Opts      *ActivityOptions
+	KeepDumps int
+}
+
+/*
+ * runs an activity according to a schedule, as production does around the clock. a run due while the previous one is
+ * still in progress is skipped (and reported as such).
+ */
+type Scheduler struct {
+	cfg     SchedulerConfig
+	results chan<- ActivityOutcome
+	mu      sync.Mutex
+	running bool
+	dumps   []string // written by the scheduled runs, oldest first - the manifest for the dumps of a chain
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+/*
+ * cfg.Opts is copied, so later changes to the caller's options do not affect the scheduled runs
+ */
+func NewScheduler(cfg SchedulerConfig, results chan<- ActivityOutcome) *Scheduler {
+	opts := *cfg.Opts.withDefaults()
+	cfg.Opts = &opts
+	return &Scheduler{cfg: cfg, results: results}
+}
+
+func (s *Scheduler) Start(ctx context.Context) {
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			next := s.cfg.Schedule.Next(time.Now())
+			if next.IsZero() {
+				_, _ = os.Stdout.WriteString(">>> oom: " + "scheduler: schedule never fires again - stopping" + "\n")
+				return
+			}
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+				s.trigger(ctx)
+			}
+		}
+	}()
+}
+
+/*
+ * stops scheduling and cancels a run in progress - returns once it is gone
+ */
+func (s *Scheduler) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+}
+
+func (s *Scheduler) trigger(ctx context.Context) {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		s.results <- ActivityOutcome{Origin: OriginScheduler, Cmd: s.cfg.Cmd, At: time.Now(), Skipped: true}
+		return
+	}
+	s.running = true
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			s.mu.Lock()
+			s.running = false
+			s.mu.Unlock()
+		}()
+
+		at := time.Now()
+		res, err := Activity(ctx, s.cfg.Cmd, s.cfg.Opts)
+		// one run at a time, see running
+		if res != nil {
+			dump := res.DumpFile
+			if res.ChainManifest != "" {
+				dump = res.ChainManifest
+			}
+			if dump != "" && (len(s.dumps) == 0 || s.dumps[len(s.dumps)-1] != dump) {
+				s.dumps = append(s.dumps, dump)
+			}
+		}
+		if s.cfg.KeepDumps > 0 {
+			s.dumps = pruneDumpFiles(s.dumps, s.cfg.KeepDumps, s.cfg.Opts.Chain.liveManifest())
+		}
+		s.results <- ActivityOutcome{Origin: OriginScheduler, Cmd: s.cfg.Cmd, At: at, Result: res, Err: err}
+	}()
+}
+
+/*
+ * keeps the `keep` most recent of files (oldest first) and returns them - a file already gone is just dropped. a chain
+ * manifest stands for the whole chain, the live one (still continued, "" for none) is kept in any case.
+ */
+func pruneDumpFiles(files []string, keep int, live string) []string {
+	if len(files) <= keep {
+		return files
+	}
+	var kept []string
+	for _, f := range files[:len(files)-keep] {
+		if f == live {
+			kept = append(kept, f)
+			continue
+		}
+		remove := []string{f}
+		if strings.HasSuffix(f, ChainManifestSuffix) {
+			remove = chainFiles(f)
+		}
+		for _, rf := range remove {
+			err := os.Remove(rf)
+			if err != nil && !os.IsNotExist(err) {
+				_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("scheduler: failed to remove old dump file %s - err: %+v", rf, err) + "\n")
+			}
+		}
+	}
+	return append(kept, files[len(files)-keep:]...)
+}
@@ -0,0 +1,130 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	for _, spec := range []string{"", "@every", "@every -1m", "@every 0s", "* * * *", "* * * * * *", "60 * * * *",
+		"* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 7", "5-1 * * * *", "*/0 * * * *", "a * * * *", "1-x * * * *"} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("schedule %q accepted", spec)
+		}
+	}
+
+	after := time.Date(2026, 1, 1, 10, 30, 20, 0, time.UTC) // a thursday
+	for _, tc := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"@every 10m", after.Add(10 * time.Minute)},
+		{"* * * * *", time.Date(2026, 1, 1, 10, 31, 0, 0, time.UTC)},
+		{"0-59/15 * * * *", time.Date(2026, 1, 1, 10, 45, 0, 0, time.UTC)},
+		{"30 * * * *", time.Date(2026, 1, 1, 11, 30, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2026, 1, 2, 2, 0, 0, 0, time.UTC)},
+		{"0 2 * * 1-5", time.Date(2026, 1, 2, 2, 0, 0, 0, time.UTC)},
+		{"0 2 * * 0,6", time.Date(2026, 1, 3, 2, 0, 0, 0, time.UTC)},
+		{"5/20 8 * * *", time.Date(2026, 1, 2, 8, 5, 0, 0, time.UTC)},
+		{"0 0 1 */3 *", time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// both day fields have to match - classic cron would fire on any 13th or any friday
+		{"0 0 13 * 5", time.Date(2026, 2, 13, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	} {
+		sched, err := ParseSchedule(tc.spec)
+		if err != nil {
+			t.Errorf("%q: %v", tc.spec, err)
+			continue
+		}
+		if got := sched.Next(after); !got.Equal(tc.want) {
+			t.Errorf("%q: next %s, want %s", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestPruneDumpFiles(t *testing.T) {
+	dir := t.TempDir()
+	var scheduled []string
+	for _, name := range []string{"dump-1.sql.gz", "dump-2.sql.gz", "dump-3.sql.gz", "dump-4.sql.gz"} {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		scheduled = append(scheduled, file)
+	}
+	other := filepath.Join(dir, "dump-0.sql.gz") // e.g. of the `DUMP` command
+	if err := os.WriteFile(other, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Remove(scheduled[0]) // removed by someone else
+
+	if kept := pruneDumpFiles(scheduled[2:], 2, ""); !reflect.DeepEqual(kept, scheduled[2:]) {
+		t.Errorf("kept %v, want %v", kept, scheduled[2:])
+	}
+	kept := pruneDumpFiles(scheduled, 2, "")
+	if !reflect.DeepEqual(kept, scheduled[2:]) {
+		t.Errorf("kept %v, want %v", kept, scheduled[2:])
+	}
+	left, _ := filepath.Glob(filepath.Join(dir, "dump-*"))
+	if want := []string{other, scheduled[2], scheduled[3]}; !reflect.DeepEqual(left, want) {
+		t.Errorf("left %v, want %v", left, want)
+	}
+}
+
+/*
+ * a chain is pruned as a whole, but never while it is continued
+ */
+func TestPruneDumpChains(t *testing.T) {
+	dir := t.TempDir()
+	touch := func(name string) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	writeManifest := func(chain string, dumps int) string {
+		manifest := ChainManifest{Chain: chain, Version: 1, State: "chain-" + chain + "-001.state.db"}
+		touch(manifest.State)
+		for seq := 0; seq < dumps; seq++ {
+			d := ChainDump{Seq: seq, Kind: ChainDumpIncremental, File: fmt.Sprintf("chain-%s-%03d-x.sql", chain, seq)}
+			touch(d.File)
+			manifest.Dumps = append(manifest.Dumps, d)
+		}
+		content, err := json.Marshal(&manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := touch("chain-" + chain + ChainManifestSuffix)
+		if err = os.WriteFile(file, content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	old, live := writeManifest("old", 2), writeManifest("live", 2)
+	plain := touch("dump-1.sql.gz")
+
+	kept := pruneDumpFiles([]string{live, old, plain}, 1, live)
+	if want := []string{live, plain}; !reflect.DeepEqual(kept, want) {
+		t.Errorf("kept %v, want %v", kept, want)
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "chain-old*")); len(left) != 0 {
+		t.Errorf("left of pruned chain: %v", left)
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "chain-live*")); len(left) != 4 {
+		t.Errorf("left of live chain: %v, want manifest, 2 dumps and state", left)
+	}
+
+	if kept = pruneDumpFiles(kept, 1, ""); !reflect.DeepEqual(kept, []string{plain}) {
+		t.Errorf("kept %v, want %v", kept, []string{plain})
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "chain-*")); len(left) != 0 {
+		t.Errorf("left of chain no longer continued: %v", left)
+	}
+}
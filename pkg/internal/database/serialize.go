@@ -0,0 +1,105 @@
+package database
+
+import (
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"gopkg.in/errgo.v2/errors"
+	"os"
+	"strings"
+)
+
+/*
+ * how the pages of MyDb get into the snapshot db:
+ * - backup: sqlite's online backup api copying chunks of pages (see createDbSnapshot) - the suspected leak trigger
+ * - serialize: sqlite3_serialize the main db into one contiguous buffer and sqlite3_deserialize it into the snapshot
+ *   connection. the snapshot db is thereby turned into an in-memory (memdb) db, whatever the strategy's conn str says.
+ * - vacuum-into: VACUUM INTO a temp file, opened read-only afterwards (see vacuum.go)
+ *
+ * serializing always passes through a go []byte (the driver copies sqlite's buffer and frees it right away). the
+ * deserialized image is a sqlite3_malloc'ed copy owned by sqlite (SQLITE_DESERIALIZE_FREEONCLOSE), freed when the
+ * snapshot connection is closed. the two serialize variants differ in who keeps the image during the activity:
+ * - serialize-go: the go buffer is retained until the snapshot is disposed => image held twice (go heap + sqlite)
+ * - serialize-sqlite: the go buffer is dropped as soon as sqlite owns its copy => image held once (sqlite only)
+ */
+type SnapshotCopyMethod string
+
+const CopyBackup SnapshotCopyMethod = "backup"
+const CopySerializeGoManaged SnapshotCopyMethod = "serialize-go"
+const CopySerializeSqliteManaged SnapshotCopyMethod = "serialize-sqlite"
+const CopyVacuumInto SnapshotCopyMethod = "vacuum-into"
+
+const DefaultCopyMethod = CopyBackup
+
+var copyMethods = []SnapshotCopyMethod{CopyBackup, CopySerializeGoManaged, CopySerializeSqliteManaged, CopyVacuumInto}
+
+func SnapshotCopyMethodByName(name string) (SnapshotCopyMethod, error) {
+	names := make([]string, 0, len(copyMethods))
+	for _, m := range copyMethods {
+		if strings.EqualFold(string(m), name) {
+			return m, nil
+		}
+		names = append(names, string(m))
+	}
+	return "", errors.New(fmt.Sprintf("unknown snapshot copy method %q - expected one of: %s", name, strings.Join(names, ", ")))
+}
+
+/*
+ * holds the go side of a serialized db image - release() hands it over to the garbage collector
+ */
+type serializedImage struct {
+	buf []byte
+}
+
+func (img *serializedImage) size() int {
+	return len(img.buf)
+}
+
+func (img *serializedImage) release() {
+	img.buf = nil
+}
+
+/*
+ * copies the whole src db into the snapshot connection. the returned image is already released for
+ * CopySerializeSqliteManaged, otherwise the caller has to release it once the snapshot is disposed
+ */
+func serializeDbSnapshot(snapshotSqliteConn *sqlite3.SQLiteConn, srcSqliteConn *sqlite3.SQLiteConn, method SnapshotCopyMethod, progress ProgressFunc) (*serializedImage, error) {
+	buf, err := srcSqliteConn.Serialize("main")
+	if err != nil {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: failed to serialize db - err: %+v", err) + "\n")
+		return nil, err
+	}
+	img := &serializedImage{buf: buf}
+
+	// Deserialize copies the image into a sqlite3_malloc'ed buffer, freed by sqlite on close of the connection
+	err = snapshotSqliteConn.Deserialize(img.buf, "main")
+	if err != nil {
+		img.release()
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: failed to deserialize db - err: %+v", err) + "\n")
+		return nil, err
+	}
+	_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: serialized %d bytes (%s)", img.size(), method) + "\n")
+	pages := img.size() / sqliteDbPageSize(img.buf)
+	progress.report(Progress{Phase: ProgressSnapshot, PagesCopied: pages, Done: true})
+
+	if method == CopySerializeSqliteManaged {
+		img.release()
+	}
+	return img, nil
+}
+
+/*
+ * page size as recorded in the db file header (offset 16, big endian, 1 meaning 65536)
+ */
+func sqliteDbPageSize(image []byte) int {
+	if len(image) < 18 {
+		return 1
+	}
+	pageSize := int(image[16])<<8 | int(image[17])
+	if pageSize == 1 {
+		return 65536
+	}
+	if pageSize == 0 {
+		return 1
+	}
+	return pageSize
+}
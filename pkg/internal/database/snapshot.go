@@ -0,0 +1,444 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"gopkg.in/errgo.v2/errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Close found some resource of the snapshot still allocated
+var ErrSnapshotNotReleased = errors.New("snapshot resources not released")
+
+// MyDb is a private in-memory db: every additional pool connection would open a new, empty db => snapshots, which may
+// now be taken concurrently (scheduler, shared snapshots), copy from MyDb one at a time
+var myDbMu sync.Mutex
+
+/*
+ * a point in time copy of MyDb. unlike the closure passed to withSnapshotDo, a Snapshot may be held, shared and
+ * inspected, but it must be disposed explicitly by Close - which is what the observed memory growth is all about.
+ */
+type Snapshot struct {
+	mu          sync.Mutex
+	db          *sql.DB
+	strategy    SnapshotStrategy
+	overridden  SnapshotStrategy // the configured strategy, if the copy method does not go with it
+	copyMethod  SnapshotCopyMethod
+	tempFile    string
+	img         *serializedImage // go side of the image of CopySerializeGoManaged, until the snapshot is disposed
+	openBackups int              // backup objects not finished - one whose Close failed stays counted
+	readerPools int              // returned by openReaders and not yet closed
+	createdAt   time.Time
+	pageCount   int64
+	pageSize    int64
+	attempts    int
+	steps       []BackupStep
+	verified    *VerificationResult
+	duration    time.Duration
+	closed      bool
+	closeErr    error
+	freed       int64 // by sqlite when closing the db, -1 if not measured
+}
+
+/*
+ * creates a snapshot of MyDb according to opts (strategy, copy method, retry and step policy). a failed snapshot is
+ * already closed when returned - any error while creating it is returned as *SnapshotError
+ */
+func OpenSnapshot(ctx context.Context, opts *ActivityOptions) (*Snapshot, error) {
+	opts = opts.withDefaults()
+	snap := &Snapshot{strategy: opts.Strategy, copyMethod: opts.CopyMethod}
+	if snap.copyMethod == CopyVacuumInto && snap.strategy != vacuumIntoStrategy {
+		snap.overridden, snap.strategy = snap.strategy, vacuumIntoStrategy
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: copy method %s overrides strategy %s - the snapshot is file based", snap.copyMethod, snap.overridden.Name()) + "\n")
+	}
+	err := snap.open(ctx, opts)
+	if err != nil {
+		closeErr := snap.Close()
+		if closeErr != nil {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: failed to dispose failed snapshot - err: %+v", closeErr) + "\n")
+		}
+		if _, ok := err.(*SnapshotError); !ok {
+			err = &SnapshotError{Attempts: snap.attempts, Elapsed: snap.duration, Reason: "fatal", Err: err}
+		}
+		return snap, err
+	}
+	return snap, nil
+}
+
+func (snap *Snapshot) open(ctx context.Context, opts *ActivityOptions) error {
+	start := time.Now()
+	defer func() {
+		snap.duration = time.Since(start)
+	}()
+
+	if snap.strategy.TempFilePattern() != "" {
+		file, err := tempSpace.createTemp(snap.strategy.TempFilePattern())
+		if err != nil {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("cannot create temporary snapshotDb file - err: %+v", err) + "\n")
+			return err
+		}
+		_ = file.Close()
+		snap.tempFile = file.Name()
+	}
+
+	snapshotConnStr := snap.strategy.ConnStr(snap.tempFile)
+	_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: using strategy %s, copy method %s", snap.strategy.Name(), snap.copyMethod) + "\n")
+
+	var err error
+	snap.db, err = sql.Open("sqlite3", snapshotConnStr)
+	if err != nil {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("cannot create snapshotDb - err: %+v", err) + "\n")
+		return err
+	}
+	snap.db.SetMaxOpenConns(1)
+
+	verify := opts.Verify != "" && opts.Verify != VerifyOff
+	var sourceDigests []TableDigest
+
+	// a retried backup/deserialize simply overwrites whatever a previous attempt copied
+	myDbMu.Lock()
+	defer myDbMu.Unlock()
+	err = opts.Retry.run(ctx, func(attempt int) error {
+		snap.attempts = attempt
+		snap.steps = snap.steps[:0]
+		if snap.copyMethod == CopyVacuumInto {
+			var err error
+			sourceDigests, err = snap.vacuumInto(ctx, verify, opts.Progress)
+			return err
+		}
+		return withSqliteConnDo(ctx, snap.db, func(snapshotSqliteConn *sqlite3.SQLiteConn) error {
+			copyDb := func(srcSqliteConn *sqlite3.SQLiteConn) error {
+				if snap.copyMethod == CopyBackup {
+					return snap.createDbSnapshot(ctx, snapshotSqliteConn, srcSqliteConn, opts.Stepping, opts.Progress)
+				}
+				var err error
+				snap.img, err = serializeDbSnapshot(snapshotSqliteConn, srcSqliteConn, snap.copyMethod, opts.Progress)
+				return err
+			}
+			if !verify {
+				return withSqliteConnDo(ctx, MyDb, copyDb)
+			}
+			return withReadTxConnDo(ctx, MyDb, func(srcConn *sql.Conn) error {
+				err := srcConn.Raw(func(driverConn interface{}) error {
+					return copyDb(driverConn.(*sqlite3.SQLiteConn))
+				})
+				if err == nil {
+					sourceDigests, err = digestTables(ctx, srcConn)
+				}
+				return err
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	snap.createdAt = time.Now()
+	err = snap.db.QueryRowContext(ctx, "PRAGMA page_count").Scan(&snap.pageCount)
+	if err == nil {
+		err = snap.db.QueryRowContext(ctx, "PRAGMA page_size").Scan(&snap.pageSize)
+	}
+	if err != nil || !verify {
+		return err
+	}
+
+	snap.verified, err = verifySnapshot(ctx, snap.db, opts.Verify, sourceDigests)
+	if err != nil {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: verification failed to run - err: %+v", err) + "\n")
+		return err
+	}
+	_, _ = os.Stdout.WriteString(">>> oom: " + "db snapshot: " + snap.verified.String() + "\n")
+	if !snap.verified.OK() {
+		return &VerificationError{Result: snap.verified}
+	}
+	return nil
+}
+
+/*
+ * like withSqliteConnDo, but holding a read transaction on the connection for the duration of exec, so the db cannot
+ * change in between two statements of exec
+ */
+func withReadTxConnDo(ctx context.Context, db *sql.DB, exec func(conn *sql.Conn) error) error {
+	connCtx, cancel := context.WithTimeout(ctx, 4*time.Minute)
+	defer cancel()
+	conn, err := db.Conn(connCtx)
+	if err != nil {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("failed to get driverConn - err: %+v", err) + "\n")
+		return err
+	}
+	defer conn.Close()
+
+	// a deferred transaction takes its shared lock with the first read
+	_, err = conn.ExecContext(ctx, "BEGIN")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = conn.ExecContext(context.Background(), "ROLLBACK")
+	}()
+	var schemaEntries int
+	err = conn.QueryRowContext(ctx, "SELECT count(*) FROM sqlite_master").Scan(&schemaEntries)
+	if err != nil {
+		return err
+	}
+
+	return exec(conn)
+}
+
+/*
+ * snapshotting uses sqlite's Backup API to copy chunk of pages. the chunk size is limited, not to block the src db for to long
+ * (see StepPolicy) - the steps taken are recorded, also when failing.
+ * when a db was updated between copying two succeeding chunks, sqlite restarts the backup from scratch. this is reported
+ * as ErrSnapshotSourceModified, which - like BUSY/LOCKED - is considered transient and triggers a retry (see RetryPolicy)
+ */
+func (snap *Snapshot) createDbSnapshot(ctx context.Context, snaphshotSqliteConn *sqlite3.SQLiteConn, srcSqliteConn *sqlite3.SQLiteConn, stepping StepPolicy, progress ProgressFunc) (err error) {
+	backup, err := snaphshotSqliteConn.Backup("main", srcSqliteConn, "main") //nolint:govet
+	if err != nil {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: failed to init db backup - err: %+v", err) + "\n")
+		return err
+	}
+	snap.openBackups++
+	defer func() {
+		closeErr := backup.Close()
+		if closeErr != nil {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: failed to close db backup - err: %+v", closeErr) + "\n")
+			if err == nil {
+				err = closeErr
+			}
+			return
+		}
+		snap.openBackups--
+	}()
+
+	var done = false
+	var remaining = -1
+	pages := stepping.initialPages()
+	sp := &snapshotProgress{progress: progress}
+	for !done && err == nil {
+		if err = ctx.Err(); err != nil {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: cancelled - err: %+v", err) + "\n")
+			return err
+		}
+		stepStart := time.Now()
+		done, err = backup.Step(pages)
+		took := time.Since(stepStart)
+		snap.steps = append(snap.steps, BackupStep{Pages: pages, Duration: took})
+		if err != nil {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: failed to copy dbPages - err: %+v", err) + "\n")
+			return err
+		}
+		if !done && remaining >= 0 && backup.Remaining() > remaining {
+			return ErrSnapshotSourceModified
+		}
+		remaining = backup.Remaining()
+		sp.step(backup.PageCount(), remaining, done)
+
+		pages = stepping.nextPages(pages, took)
+		if !done && stepping.Pause > 0 {
+			// cut short by a cancelled ctx - told at the top of the loop
+			pause := time.NewTimer(stepping.Pause)
+			select {
+			case <-pause.C:
+			case <-ctx.Done():
+				pause.Stop()
+			}
+		}
+	}
+	return err
+}
+
+/*
+ * disposes the snapshot db, the go side of a serialized image and the temp file (if any) and verifies that each of
+ * them is actually gone: no backup object left unfinished, no connection left open, the temp file removed. safe to call
+ * more than once - later calls return the outcome of the first one.
+ * what sqlite's allocations drop by when closing the db of a snapshot held in memory is a measurement, not a failure -
+ * see Freed.
+ */
+func (snap *Snapshot) Close() error {
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	if snap.closed {
+		return snap.closeErr
+	}
+	snap.closed = true
+
+	snap.freed = -1
+	problems := make([]string, 0, 4)
+	if snap.openBackups != 0 {
+		problems = append(problems, fmt.Sprintf("%d backup object(s) still open", snap.openBackups))
+	}
+	if snap.readerPools != 0 {
+		problems = append(problems, fmt.Sprintf("%d reader pool(s) still open", snap.readerPools))
+	}
+	if snap.db != nil {
+		used := sqliteMemoryUsed()
+		err := snap.db.Close()
+		freed := used - sqliteMemoryUsed()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("closing snapshot db: %v", err))
+		} else if open := snap.db.Stats().OpenConnections; open != 0 {
+			problems = append(problems, fmt.Sprintf("%d snapshot db connection(s) still open", open))
+		} else if snap.inMemory() {
+			snap.freed = freed
+			if !memoryReleased(freed, snap.ByteSize()) {
+				_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: sqlite freed %d bytes, the snapshot db held %d", freed, snap.ByteSize()) + "\n")
+			}
+		}
+	}
+	if snap.img != nil {
+		snap.img.release() // up to the garbage collector from now on
+	}
+	if snap.tempFile != "" {
+		err := tempSpace.removeTemp(snap.tempFile)
+		if err != nil {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("failed to remove temp snapshot db file %s", snap.tempFile) + "\n")
+		}
+		if _, statErr := os.Stat(snap.tempFile); !os.IsNotExist(statErr) {
+			problems = append(problems, fmt.Sprintf("temp file %s still present", snap.tempFile))
+		}
+	}
+
+	if len(problems) > 0 {
+		snap.closeErr = errors.Because(ErrSnapshotNotReleased, ErrSnapshotNotReleased, strings.Join(problems, "; "))
+	}
+	return snap.closeErr
+}
+
+// whether the snapshot db's pages live in sqlite's memory rather than in a file
+func (snap *Snapshot) inMemory() bool {
+	if snap.copyMethod == CopySerializeGoManaged || snap.copyMethod == CopySerializeSqliteManaged {
+		return true
+	}
+	return snap.strategy != StrategyTempFile && snap.strategy != vacuumIntoStrategy
+}
+
+/*
+ * a pool of up to n read-only connections to the snapshot db, e.g. to dump tables in parallel - nil if further
+ * connections would not see the snapshot: a private in-memory db (see SnapshotStrategy.ReaderConnStr) or a
+ * deserialized image, which lives in the snapshot connection only. to be closed by closeReaders before the snapshot.
+ */
+func (snap *Snapshot) openReaders(n int) (*sql.DB, error) {
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	if snap.closed {
+		return nil, errors.New("snapshot already closed")
+	}
+	if snap.copyMethod == CopySerializeGoManaged || snap.copyMethod == CopySerializeSqliteManaged {
+		return nil, nil
+	}
+	connStr := snap.strategy.ReaderConnStr(snap.tempFile)
+	if connStr == "" {
+		return nil, nil
+	}
+	readers, err := sql.Open("sqlite3", connStr)
+	if err != nil {
+		return nil, err
+	}
+	readers.SetMaxOpenConns(n)
+	snap.readerPools++
+	return readers, nil
+}
+
+func (snap *Snapshot) closeReaders(readers *sql.DB) error {
+	err := readers.Close()
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	if err == nil {
+		snap.readerPools--
+	}
+	return err
+}
+
+// the snapshot db - nil once the snapshot is closed
+func (snap *Snapshot) DB() *sql.DB {
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	if snap.closed {
+		return nil
+	}
+	return snap.db
+}
+
+func (snap *Snapshot) Closed() bool {
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	return snap.closed
+}
+
+func (snap *Snapshot) CreatedAt() time.Time {
+	return snap.createdAt
+}
+
+func (snap *Snapshot) Age() time.Duration {
+	return time.Since(snap.createdAt)
+}
+
+func (snap *Snapshot) PageCount() int64 {
+	return snap.pageCount
+}
+
+/*
+ * what sqlite's allocations dropped by when Close closed the db of a snapshot held in memory - -1 for a file based one,
+ * before Close or if closing failed.
+ * NOTE: sqlite's memory figure is process wide, another snapshot being copied in the meantime may mask what is freed
+ */
+func (snap *Snapshot) Freed() int64 {
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	if !snap.closed {
+		return -1
+	}
+	return snap.freed
+}
+
+// at least half of what the snapshot db held - allowing for sqlite's caches and the process wide figure
+func memoryReleased(freed int64, byteSize int64) bool {
+	return freed >= byteSize/2
+}
+
+func (snap *Snapshot) ByteSize() int64 {
+	return snap.pageCount * snap.pageSize
+}
+
+func (snap *Snapshot) Strategy() SnapshotStrategy {
+	return snap.strategy
+}
+
+// the configured strategy, if the copy method replaced it (see CopyVacuumInto) - nil otherwise
+func (snap *Snapshot) OverriddenStrategy() SnapshotStrategy {
+	return snap.overridden
+}
+
+func (snap *Snapshot) CopyMethod() SnapshotCopyMethod {
+	return snap.copyMethod
+}
+
+// number of attempts it took to create the snapshot
+func (snap *Snapshot) Attempts() int {
+	return snap.attempts
+}
+
+// backup steps of the successful attempt - empty for serialized snapshots
+func (snap *Snapshot) Steps() []BackupStep {
+	return snap.steps
+}
+
+// outcome of the verification - nil if not verified
+func (snap *Snapshot) Verification() *VerificationResult {
+	return snap.verified
+}
+
+// time it took to create the snapshot incl. retries
+func (snap *Snapshot) Duration() time.Duration {
+	return snap.duration
+}
+
+func (snap *Snapshot) String() string {
+	return fmt.Sprintf("snapshot(strategy=%s copy=%s pages=%d bytes=%d created=%s)", snap.strategy.Name(), snap.copyMethod,
+		snap.pageCount, snap.ByteSize(), snap.createdAt.Format(time.RFC3339))
+}
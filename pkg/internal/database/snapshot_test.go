@@ -0,0 +1,86 @@
+package database
+
+import (
+	"context"
+	"gopkg.in/errgo.v2/errors"
+	"os"
+	"testing"
+)
+
+/*
+ * Close releases what each variant allocated - sqlite's memory resp. the temp file - and tells the same outcome every
+ * time it is called
+ */
+func TestSnapshotClose(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		strategy   SnapshotStrategy
+		copyMethod SnapshotCopyMethod
+	}{
+		{StrategyPrivateMemory, CopyBackup},
+		{StrategyTempFile, CopyBackup},
+		{StrategyAnonymousMemory, CopyBackup},
+		{StrategyMemdb, CopyBackup},
+		{StrategyPrivateMemory, CopySerializeSqliteManaged},
+		{StrategyPrivateMemory, CopySerializeGoManaged},
+		{StrategyPrivateMemory, CopyVacuumInto},
+	} {
+		opts := DefaultActivityOptions()
+		opts.Strategy, opts.CopyMethod = tc.strategy, tc.copyMethod
+		before := sqliteMemoryUsed()
+		snap, err := OpenSnapshot(ctx, opts)
+		if err != nil {
+			t.Fatalf("%s/%s: %v", tc.strategy.Name(), tc.copyMethod, err)
+		}
+		if snap.inMemory() && sqliteMemoryUsed()-before < snap.ByteSize() {
+			t.Errorf("%s/%s: snapshot of %d bytes not held by sqlite", tc.strategy.Name(), tc.copyMethod, snap.ByteSize())
+		}
+		// the go side of the image is kept until Close - only by serialize-go
+		if held := snap.img != nil && snap.img.size() == int(snap.ByteSize()); held != (tc.copyMethod == CopySerializeGoManaged) {
+			t.Errorf("%s/%s: go-managed image held: %t", tc.strategy.Name(), tc.copyMethod, held)
+		}
+		tempFile := snap.tempFile
+		for i := 0; i < 2; i++ {
+			if err := snap.Close(); err != nil {
+				t.Errorf("%s/%s: Close #%d: %v", tc.strategy.Name(), tc.copyMethod, i+1, err)
+			}
+		}
+		if freed := snap.Freed(); snap.inMemory() && !memoryReleased(freed, snap.ByteSize()) || !snap.inMemory() && freed != -1 {
+			t.Errorf("%s/%s: sqlite freed %d bytes of %d", tc.strategy.Name(), tc.copyMethod, freed, snap.ByteSize())
+		}
+		if snap.img != nil && snap.img.size() != 0 {
+			t.Errorf("%s/%s: go-managed image still held", tc.strategy.Name(), tc.copyMethod)
+		}
+		if !snap.Closed() || snap.DB() != nil {
+			t.Errorf("%s/%s: snapshot still open", tc.strategy.Name(), tc.copyMethod)
+		}
+		if tempFile != "" {
+			if _, err := os.Stat(tempFile); !os.IsNotExist(err) {
+				t.Errorf("%s/%s: temp file %s left behind", tc.strategy.Name(), tc.copyMethod, tempFile)
+			}
+		}
+	}
+
+	// readers left open make Close fail - and keep failing the same way
+	opts := DefaultActivityOptions()
+	opts.Strategy = StrategyTempFile
+	snap, err := OpenSnapshot(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readers, err := snap.openReaders(2)
+	if err != nil || readers == nil {
+		t.Fatalf("got readers %v, err %v", readers, err)
+	}
+	defer readers.Close()
+	err = snap.Close()
+	if errors.Cause(err) != ErrSnapshotNotReleased {
+		t.Fatalf("got %v, want ErrSnapshotNotReleased", err)
+	}
+	if again := snap.Close(); again != err {
+		t.Errorf("second Close got %v, want %v", again, err)
+	}
+	if _, err := snap.openReaders(1); err == nil {
+		t.Errorf("readers of a closed snapshot")
+	}
+}
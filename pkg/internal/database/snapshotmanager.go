@@ -0,0 +1,203 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/errgo.v2/errors"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrSnapshotManagerClosed = errors.New("snapshot manager closed")
+
+/*
+ * shares one snapshot among concurrent readers (dump, ad-hoc queries, verification ...) instead of each of them taking
+ * its own copy of MyDb:
+ * - Acquire hands out a lease on the current snapshot, creating one if there is none or if it is older than maxAge
+ * - a snapshot is closed as soon as its last lease is released - an outdated snapshot is no longer handed out, but
+ *   stays open for the leases still holding it
+ * maxAge 0 means a snapshot is reused as long as it is leased.
+ */
+type SnapshotManager struct {
+	mu       sync.Mutex
+	opts     func() *ActivityOptions
+	maxAge   time.Duration
+	current  *sharedSnapshot
+	creating *snapshotCreation // the snapshot being created, outside of mu
+	closed   bool
+}
+
+/*
+ * done is closed once the snapshot is current - or failed with err
+ */
+type snapshotCreation struct {
+	done      chan struct{}
+	err       error
+	cancelled bool // by the creator's ctx
+}
+
+type sharedSnapshot struct {
+	snap *Snapshot
+	refs int
+}
+
+/*
+ * a reader's claim on a shared snapshot - must be released exactly once, further calls are ignored
+ */
+type SnapshotLease struct {
+	mgr    *SnapshotManager
+	shared *sharedSnapshot
+	once   sync.Once
+}
+
+/*
+ * opts is called whenever a new snapshot is created, so later changes to the options it returns (e.g. the strategy)
+ * apply to the next refresh. it has to return options of the manager's own - e.g. a copy taken under the lock guarding
+ * the caller's options - and is not called while the manager holds its lock.
+ */
+func NewSnapshotManager(opts func() *ActivityOptions, maxAge time.Duration) *SnapshotManager {
+	return &SnapshotManager{opts: opts, maxAge: maxAge}
+}
+
+func (m *SnapshotManager) SetMaxAge(maxAge time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxAge = maxAge
+}
+
+/*
+ * concurrent callers needing a new snapshot wait for the one being created instead of creating their own - as long as
+ * their ctx allows. creating a snapshot may take long (stepping pauses, retries), so it happens without holding m.mu:
+ * releasing leases, Current and SetMaxAge never wait for it.
+ */
+func (m *SnapshotManager) Acquire(ctx context.Context) (*SnapshotLease, error) {
+	for {
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return nil, ErrSnapshotManagerClosed
+		}
+
+		if m.current != nil && m.maxAge > 0 && m.current.snap.Age() > m.maxAge {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: refreshing snapshot older than %s", m.maxAge) + "\n")
+			err := m.retire(m.current)
+			if err != nil {
+				_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: failed to dispose outdated snapshot - err: %+v", err) + "\n")
+			}
+			m.current = nil
+		}
+
+		if m.current != nil {
+			m.current.refs++
+			lease := &SnapshotLease{mgr: m, shared: m.current}
+			m.mu.Unlock()
+			return lease, nil
+		}
+
+		creation := m.creating
+		if creation == nil {
+			creation = &snapshotCreation{done: make(chan struct{})}
+			m.creating = creation
+			m.mu.Unlock()
+			opts := m.opts().withDefaults()
+			opts.Snapshots = nil
+			return m.create(ctx, creation, opts)
+		}
+		m.mu.Unlock()
+
+		select {
+		case <-creation.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// one cancelled by its creator is retried, e.g. by this caller
+		if creation.err != nil && !creation.cancelled {
+			return nil, creation.err
+		}
+	}
+}
+
+// creates the current snapshot, leased to the caller
+func (m *SnapshotManager) create(ctx context.Context, creation *snapshotCreation, opts *ActivityOptions) (*SnapshotLease, error) {
+	snap, err := OpenSnapshot(ctx, opts)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer close(creation.done)
+	m.creating = nil
+	if err == nil && m.closed {
+		err = ErrSnapshotManagerClosed
+		closeErr := snap.Close()
+		if closeErr != nil {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: failed to dispose snapshot - err: %+v", closeErr) + "\n")
+		}
+	}
+	if err != nil {
+		creation.err, creation.cancelled = err, ctx.Err() != nil
+		return nil, err
+	}
+	m.current = &sharedSnapshot{snap: snap, refs: 1}
+	return &SnapshotLease{mgr: m, shared: m.current}, nil
+}
+
+// the current snapshot and the number of leases on it - nil, 0 if there is none
+func (m *SnapshotManager) Current() (*Snapshot, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.current == nil {
+		return nil, 0
+	}
+	return m.current.snap, m.current.refs
+}
+
+/*
+ * no further leases are handed out, the current snapshot is closed once its last lease is released
+ */
+func (m *SnapshotManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	if m.current == nil {
+		return nil
+	}
+	shared := m.current
+	m.current = nil
+	return m.retire(shared)
+}
+
+// must be called with m.mu held
+func (m *SnapshotManager) retire(shared *sharedSnapshot) error {
+	if shared.refs > 0 {
+		return nil
+	}
+	return shared.snap.Close()
+}
+
+func (m *SnapshotManager) release(shared *sharedSnapshot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	shared.refs--
+	if shared.refs > 0 {
+		return nil
+	}
+	if m.current == shared {
+		m.current = nil
+	}
+	return shared.snap.Close()
+}
+
+func (l *SnapshotLease) Snapshot() *Snapshot {
+	return l.shared.snap
+}
+
+/*
+ * closes the snapshot if this was its last lease - the error is the one of Snapshot.Close
+ */
+func (l *SnapshotLease) Release() error {
+	var err error
+	l.once.Do(func() {
+		err = l.mgr.release(l.shared)
+	})
+	return err
+}
@@ -0,0 +1,149 @@
+package database
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSnapshotManagerRefCounting(t *testing.T) {
+	ctx := context.Background()
+	mgr := NewSnapshotManager(DefaultActivityOptions, 0)
+	defer mgr.Close()
+
+	first, err := mgr.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := mgr.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := first.Snapshot()
+	if second.Snapshot() != snap {
+		t.Fatalf("leases on different snapshots")
+	}
+	if current, refs := mgr.Current(); current != snap || refs != 2 {
+		t.Errorf("current %v with %d lease(s), want %v with 2", current, refs, snap)
+	}
+
+	if err = first.Release(); err != nil || snap.Closed() {
+		t.Errorf("snapshot closed with a lease left (err %v)", err)
+	}
+	if err = first.Release(); err != nil {
+		t.Errorf("second release: %v", err)
+	}
+	if _, refs := mgr.Current(); refs != 1 {
+		t.Errorf("%d lease(s) after a double release, want 1", refs)
+	}
+	if err = second.Release(); err != nil || !snap.Closed() {
+		t.Errorf("snapshot open after its last release (err %v)", err)
+	}
+	if current, _ := mgr.Current(); current != nil {
+		t.Errorf("released snapshot still current")
+	}
+
+	var wg sync.WaitGroup
+	leases := make([]*SnapshotLease, 8)
+	for i := range leases {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			leases[i], _ = mgr.Acquire(ctx)
+		}(i)
+	}
+	wg.Wait()
+	for _, lease := range leases {
+		if lease == nil || lease.Snapshot() != leases[0].Snapshot() {
+			t.Fatalf("concurrent leases not sharing a single snapshot")
+		}
+	}
+	for _, lease := range leases {
+		_ = lease.Release()
+	}
+	if !leases[0].Snapshot().Closed() {
+		t.Errorf("shared snapshot open after all releases")
+	}
+}
+
+func TestSnapshotManagerMaxAge(t *testing.T) {
+	ctx := context.Background()
+	mgr := NewSnapshotManager(DefaultActivityOptions, 0)
+	defer mgr.Close()
+
+	old, err := mgr.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr.SetMaxAge(time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	fresh, err := mgr.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh.Snapshot() == old.Snapshot() {
+		t.Fatalf("outdated snapshot handed out")
+	}
+	if old.Snapshot().Closed() {
+		t.Errorf("outdated snapshot closed while still leased")
+	}
+	if current, refs := mgr.Current(); current != fresh.Snapshot() || refs != 1 {
+		t.Errorf("current %v with %d lease(s), want the fresh one with 1", current, refs)
+	}
+	_ = old.Release()
+	if !old.Snapshot().Closed() {
+		t.Errorf("outdated snapshot open after its last release")
+	}
+	_ = fresh.Release()
+
+	mgr.SetMaxAge(0)
+	_ = mgr.Close()
+	if _, err = mgr.Acquire(ctx); err != ErrSnapshotManagerClosed {
+		t.Errorf("got %v from a closed manager", err)
+	}
+}
+
+/*
+ * a slow snapshot being created blocks neither Current nor callers giving up
+ */
+func TestSnapshotManagerSlowCreation(t *testing.T) {
+	opts := DefaultActivityOptions()
+	opts.Stepping = StepPolicy{Pages: 1, Pause: 20 * time.Millisecond}
+	mgr := NewSnapshotManager(func() *ActivityOptions { return opts }, 0)
+	defer mgr.Close()
+
+	created := make(chan *SnapshotLease)
+	go func() {
+		lease, err := mgr.Acquire(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		created <- lease
+	}()
+	time.Sleep(30 * time.Millisecond)
+
+	start := time.Now()
+	if current, _ := mgr.Current(); current != nil {
+		t.Errorf("snapshot current while being created")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := mgr.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+	if took := time.Since(start); took > 100*time.Millisecond {
+		t.Errorf("blocked for %s by the snapshot being created", took)
+	}
+
+	waiter, err := mgr.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease := <-created
+	if lease == nil || waiter.Snapshot() != lease.Snapshot() {
+		t.Fatalf("waiter got a snapshot of its own")
+	}
+	_ = waiter.Release()
+	_ = lease.Release()
+}
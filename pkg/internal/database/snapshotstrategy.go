@@ -0,0 +1,134 @@
+package database
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"gopkg.in/errgo.v2/errors"
+	"strings"
+)
+
+/*
+ * decides what kind of db a snapshot is copied into. all variants observed so far are available side by side, so they
+ * can be compared within the same build instead of (un)commenting connection strings.
+ */
+type SnapshotStrategy interface {
+	Name() string
+	// pattern for os.CreateTemp, "" when the strategy does not need a temp file
+	TempFilePattern() string
+	// connection string of the snapshot db, tempFile is "" when TempFilePattern() is ""
+	ConnStr(tempFile string) string
+	// connection string of further, read-only connections to a completed snapshot db (e.g. for a parallel dump) - ""
+	// when another connection would not see the snapshot
+	ReaderConnStr(tempFile string) string
+}
+
+// ORIG: in-memory db addressed by a distinct (temp) file url => shows the memory leak
+var StrategyPrivateMemory SnapshotStrategy = &privateMemoryStrategy{}
+
+// WORKAROUND: file based db instead of in-mem (mode=rwc) => slower when creating snapshot db, but no memory growth
+var StrategyTempFile SnapshotStrategy = &tempFileStrategy{}
+
+// proposed in https://github.com/mattn/go-sqlite3/issues/1005#issuecomment-1019029882 : use `:memory:` instead of temp file name
+// => no impact on increasing memory consumption behavior
+var StrategyAnonymousMemory SnapshotStrategy = &anonymousMemoryStrategy{}
+
+// in-memory db backed by sqlite's memdb vfs (the vfs behind sqlite3_deserialize) instead of the default in-mem pager
+var StrategyMemdb SnapshotStrategy = &memdbStrategy{}
+
+var DefaultSnapshotStrategy = StrategyPrivateMemory
+
+var snapshotStrategies = []SnapshotStrategy{StrategyPrivateMemory, StrategyTempFile, StrategyAnonymousMemory, StrategyMemdb}
+
+func SnapshotStrategies() []SnapshotStrategy {
+	return append([]SnapshotStrategy(nil), snapshotStrategies...)
+}
+
+func SnapshotStrategyByName(name string) (SnapshotStrategy, error) {
+	names := make([]string, 0, len(snapshotStrategies))
+	for _, s := range snapshotStrategies {
+		if strings.EqualFold(s.Name(), name) {
+			return s, nil
+		}
+		names = append(names, s.Name())
+	}
+	return nil, errors.New(fmt.Sprintf("unknown snapshot strategy %q - expected one of: %s", name, strings.Join(names, ", ")))
+}
+
+type privateMemoryStrategy struct{}
+
+func (s *privateMemoryStrategy) Name() string {
+	return "memory"
+}
+
+func (s *privateMemoryStrategy) TempFilePattern() string {
+	return ".snapshot-*.db"
+}
+
+func (s *privateMemoryStrategy) ConnStr(tempFile string) string {
+	// TESTING some conn str uri params => no effect - still memory leaking
+	// "file:%s?mode=memory&cache=private&_journal_mode=OFF&_fk=off&_mutex=no"
+	return fmt.Sprintf("file:%s?mode=memory&cache=private&_journal_mode=OFF&_fk=off&_query_only=true&_locking=EXCLUSIVE&_mutex=no", tempFile)
+}
+
+// private to the snapshot connection - another one opens a new, empty db
+func (s *privateMemoryStrategy) ReaderConnStr(_ string) string {
+	return ""
+}
+
+type tempFileStrategy struct{}
+
+func (s *tempFileStrategy) Name() string {
+	return "tempfile"
+}
+
+func (s *tempFileStrategy) TempFilePattern() string {
+	return ".snapshot-*.db"
+}
+
+func (s *tempFileStrategy) ConnStr(tempFile string) string {
+	return fmt.Sprintf("file:%s?mode=rwc&cache=private&_journal_mode=OFF&_fk=off&_query_only=true&_locking=EXCLUSIVE&_mutex=no", tempFile)
+}
+
+// the snapshot connection keeps its exclusive lock - a completed snapshot does not change anymore, so readers may
+// ignore locks (immutable)
+func (s *tempFileStrategy) ReaderConnStr(tempFile string) string {
+	return fmt.Sprintf("file:%s?mode=ro&immutable=1&cache=private&_query_only=true&_mutex=no", tempFile)
+}
+
+type anonymousMemoryStrategy struct{}
+
+func (s *anonymousMemoryStrategy) Name() string {
+	return "anonymous"
+}
+
+func (s *anonymousMemoryStrategy) TempFilePattern() string {
+	return ""
+}
+
+func (s *anonymousMemoryStrategy) ConnStr(_ string) string {
+	return "file::memory:?mode=memory&cache=private&_journal_mode=OFF&_fk=off&_query_only=true&_locking=EXCLUSIVE&_mutex=no"
+}
+
+func (s *anonymousMemoryStrategy) ReaderConnStr(_ string) string {
+	return ""
+}
+
+type memdbStrategy struct{}
+
+func (s *memdbStrategy) Name() string {
+	return "memdb"
+}
+
+func (s *memdbStrategy) TempFilePattern() string {
+	return ""
+}
+
+func (s *memdbStrategy) ConnStr(_ string) string {
+	// memdb names must start with a '/' and are process wide => unique name per snapshot
+	return fmt.Sprintf("file:/snapshot-%s.db?vfs=memdb&_journal_mode=OFF&_fk=off&_query_only=true&_locking=EXCLUSIVE&_mutex=no", uuid.New().String())
+}
+
+// a memdb is process wide, but the snapshot connection keeps an exclusive lock on it
+func (s *memdbStrategy) ReaderConnStr(_ string) string {
+	return ""
+}
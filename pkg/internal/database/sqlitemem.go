@@ -0,0 +1,14 @@
+package database
+
+/*
+// the sqlite library compiled into go-sqlite3 - the driver does not expose its api beyond database/sql
+extern long long sqlite3_memory_used(void);
+*/
+import "C"
+
+/*
+ * bytes currently allocated by sqlite, process wide - see sqlite3_memory_used
+ */
+func sqliteMemoryUsed() int64 {
+	return int64(C.sqlite3_memory_used())
+}
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"time"
+)
+
+/*
+ * how many pages each backup.Step copies. every step holds a read lock on the source db, so the chunk size trades
+ * snapshot duration against the time other requests are blocked:
+ * - fixed: always Pages pages per step (the original 250)
+ * - adaptive: starts with Pages and scales the chunk size after each step by TargetLatency / measured step duration
+ *   (at most doubling resp. halving it per step), kept within MinPages..MaxPages
+ * an optional Pause between two steps gives writers a chance to get hold of the source db.
+ */
+type StepPolicy struct {
+	Pages         int
+	Adaptive      bool
+	TargetLatency time.Duration
+	MinPages      int
+	MaxPages      int
+	Pause         time.Duration
+}
+
+var DefaultStepPolicy = StepPolicy{
+	Pages:         250,
+	Adaptive:      false,
+	TargetLatency: 5 * time.Millisecond,
+	MinPages:      16,
+	MaxPages:      16384,
+}
+
+/*
+ * a single backup.Step as chosen and measured
+ */
+type BackupStep struct {
+	Pages    int
+	Duration time.Duration
+}
+
+func (p StepPolicy) initialPages() int {
+	pages := p.Pages
+	if pages <= 0 {
+		pages = DefaultStepPolicy.Pages
+	}
+	return p.clamp(pages)
+}
+
+func (p StepPolicy) clamp(pages int) int {
+	if !p.Adaptive {
+		return pages
+	}
+	if p.MinPages > 0 && pages < p.MinPages {
+		pages = p.MinPages
+	}
+	if p.MaxPages > 0 && pages > p.MaxPages {
+		pages = p.MaxPages
+	}
+	if pages < 1 {
+		pages = 1
+	}
+	return pages
+}
+
+func (p StepPolicy) nextPages(pages int, took time.Duration) int {
+	if !p.Adaptive || p.TargetLatency <= 0 {
+		return pages
+	}
+	next := 2 * pages
+	if took > 0 {
+		next = int(float64(pages) * float64(p.TargetLatency) / float64(took))
+	}
+	if next > 2*pages {
+		next = 2 * pages
+	} else if next < pages/2 {
+		next = pages / 2
+	}
+	return p.clamp(next)
+}
+
+/*
+ * summary of the steps of a snapshot - all zero if there were none (e.g. serialized snapshot)
+ */
+type StepSummary struct {
+	Steps       int
+	MinPages    int
+	MaxPages    int
+	AvgDuration time.Duration
+	MaxDuration time.Duration
+}
+
+func summarizeSteps(steps []BackupStep) StepSummary {
+	var sum StepSummary
+	var total time.Duration
+	for i, s := range steps {
+		if i == 0 || s.Pages < sum.MinPages {
+			sum.MinPages = s.Pages
+		}
+		if s.Pages > sum.MaxPages {
+			sum.MaxPages = s.Pages
+		}
+		if s.Duration > sum.MaxDuration {
+			sum.MaxDuration = s.Duration
+		}
+		total += s.Duration
+	}
+	sum.Steps = len(steps)
+	if sum.Steps > 0 {
+		sum.AvgDuration = total / time.Duration(sum.Steps)
+	}
+	return sum
+}
@@ -0,0 +1,84 @@
+package database
+
+import (
+	"context"
+	"gopkg.in/errgo.v2/errors"
+	"testing"
+	"time"
+)
+
+func TestStepPolicySizing(t *testing.T) {
+	adaptive := StepPolicy{Pages: 100, Adaptive: true, TargetLatency: 4 * time.Millisecond, MinPages: 16, MaxPages: 1000}
+	fixed := StepPolicy{Pages: 100, TargetLatency: 4 * time.Millisecond}
+	for _, tc := range []struct {
+		name   string
+		policy StepPolicy
+		pages  int
+		took   time.Duration
+		want   int
+	}{
+		{"fixed keeps pages", fixed, 100, time.Millisecond, 100},
+		{"on target", adaptive, 100, 4 * time.Millisecond, 100},
+		{"faster scales up", adaptive, 100, 3 * time.Millisecond, 133},
+		{"at most doubling", adaptive, 100, time.Millisecond, 200},
+		{"unmeasurable step doubles", adaptive, 100, 0, 200},
+		{"slower scales down", adaptive, 100, 5 * time.Millisecond, 80},
+		{"at most halving", adaptive, 100, time.Second, 50},
+		{"min pages", adaptive, 20, time.Second, 16},
+		{"max pages", adaptive, 800, time.Millisecond, 1000},
+		{"no target keeps pages", StepPolicy{Pages: 100, Adaptive: true}, 100, time.Millisecond, 100},
+	} {
+		if got := tc.policy.nextPages(tc.pages, tc.took); got != tc.want {
+			t.Errorf("%s: nextPages(%d, %s) = %d, want %d", tc.name, tc.pages, tc.took, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		policy StepPolicy
+		want   int
+	}{
+		{"configured", StepPolicy{Pages: 100}, 100},
+		{"default", StepPolicy{}, DefaultStepPolicy.Pages},
+		{"adaptive within bounds", StepPolicy{Pages: 5000, Adaptive: true, MaxPages: 1000}, 1000},
+		{"fixed ignores bounds", StepPolicy{Pages: 5000, MaxPages: 1000}, 5000},
+	} {
+		if got := tc.policy.initialPages(); got != tc.want {
+			t.Errorf("%s: initialPages() = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSummarizeSteps(t *testing.T) {
+	sum := summarizeSteps([]BackupStep{{Pages: 100, Duration: 2 * time.Millisecond}, {Pages: 50, Duration: 6 * time.Millisecond}, {Pages: 200, Duration: time.Millisecond}})
+	want := StepSummary{Steps: 3, MinPages: 50, MaxPages: 200, AvgDuration: 3 * time.Millisecond, MaxDuration: 6 * time.Millisecond}
+	if sum != want {
+		t.Errorf("got %+v, want %+v", sum, want)
+	}
+	if sum := summarizeSteps(nil); sum != (StepSummary{}) {
+		t.Errorf("no steps: got %+v", sum)
+	}
+}
+
+/*
+ * a cancelled ctx cuts a pause between backup steps short
+ */
+func TestSteppingPauseCancelled(t *testing.T) {
+	opts := DefaultActivityOptions()
+	opts.Stepping = StepPolicy{Pages: 1, Pause: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	start := time.Now()
+	snap, err := OpenSnapshot(ctx, opts)
+	if err == nil {
+		_ = snap.Close()
+	}
+	if errors.Cause(err) != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("cancelled snapshot took %s", took)
+	}
+}
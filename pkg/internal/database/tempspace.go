@@ -0,0 +1,189 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+/*
+ * the directory all files of this process go to: the (empty) file naming MyDb, temp snapshot dbs and dump files.
+ * temp files carry the owning pid (`-p<pid>-`) in their name, so a later run can tell files left behind by a crashed
+ * run from those of a still running one. dumps are written as `*.partial` and renamed once complete.
+ */
+type TempSpace struct {
+	mu    sync.Mutex
+	dir   string
+	files map[string]bool // created and not yet removed - see Cleanup
+}
+
+// EnvTempDir overrides the default base directory DefaultTempDir
+const EnvTempDir = "OOM_TEMP_DIR"
+const DefaultTempDir = "tmp"
+
+const partialSuffix = ".partial"
+
+var tempSpace = &TempSpace{dir: DefaultTempDir, files: make(map[string]bool)}
+
+// file name patterns of this package's temp files - anything matching these and not owned by a live process is stale
+var stalePatterns = []string{".oom-*.db", ".snapshot-*.db", ".export-*", ".chain-*", "dump-*" + partialSuffix, "chain-*" + partialSuffix}
+
+var ownerPidRegexp = regexp.MustCompile(`-p(\d+)-`)
+
+/*
+ * sets up the temp space in dir ("" for $OOM_TEMP_DIR resp. DefaultTempDir): creates the directory if missing and
+ * removes stale files of crashed runs - returns the removed files
+ */
+func InitTempSpace(dir string) ([]string, error) {
+	if dir == "" {
+		dir = os.Getenv(EnvTempDir)
+	}
+	if dir == "" {
+		dir = DefaultTempDir
+	}
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	tempSpace.mu.Lock()
+	tempSpace.dir = dir
+	tempSpace.mu.Unlock()
+	return tempSpace.sweepStale()
+}
+
+func TempDir() string {
+	tempSpace.mu.Lock()
+	defer tempSpace.mu.Unlock()
+	return tempSpace.dir
+}
+
+/*
+ * like os.CreateTemp, but within the temp space and tagged with the owning pid. the file is tracked until removed by
+ * removeTemp (or Cleanup).
+ */
+func (ts *TempSpace) createTemp(pattern string) (*os.File, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	err := os.MkdirAll(ts.dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	ownedPattern := strings.Replace(pattern, "*", fmt.Sprintf("p%d-*", os.Getpid()), 1)
+	file, err := os.CreateTemp(ts.dir, ownedPattern)
+	if err != nil {
+		return nil, err
+	}
+	ts.files[file.Name()] = true
+	return file, nil
+}
+
+func (ts *TempSpace) removeTemp(name string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	err := os.RemoveAll(name)
+	if err == nil {
+		delete(ts.files, name)
+	}
+	return err
+}
+
+/*
+ * a completed file is no temp file anymore, e.g. a dump renamed from `*.partial` to its final name
+ */
+func (ts *TempSpace) keep(tempName string, finalName string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	err := os.Rename(tempName, finalName)
+	if err == nil {
+		delete(ts.files, tempName)
+	}
+	return err
+}
+
+func (ts *TempSpace) sweepStale() ([]string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	removed := make([]string, 0)
+	for _, pattern := range stalePatterns {
+		files, err := filepath.Glob(filepath.Join(ts.dir, pattern))
+		if err != nil {
+			return removed, err
+		}
+		for _, f := range files {
+			if ts.files[f] || ownerAlive(filepath.Base(f)) {
+				continue
+			}
+			err = os.RemoveAll(f)
+			if err != nil {
+				return removed, err
+			}
+			removed = append(removed, f)
+		}
+	}
+	return removed, nil
+}
+
+/*
+ * files without owner tag stem from versions before the temp space - always stale
+ */
+func ownerAlive(fileName string) bool {
+	m := ownerPidRegexp.FindStringSubmatch(fileName)
+	if m == nil {
+		return false
+	}
+	pid, err := strconv.Atoi(m[1])
+	if err != nil {
+		return false
+	}
+	if pid == os.Getpid() {
+		return true
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// FindProcess already fails for a non-existing process, Signal(0) is not supported
+		_ = process.Release()
+		return true
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+/*
+ * removes all files still tracked by the temp space - safe to be called concurrently and repeatedly, e.g. from a
+ * signal handler and a deferred call
+ */
+func CleanupTempSpace() {
+	tempSpace.mu.Lock()
+	defer tempSpace.mu.Unlock()
+
+	for f := range tempSpace.files {
+		err := os.RemoveAll(f)
+		if err != nil {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("failed to remove temp file %s - err: %+v", f, err) + "\n")
+			continue
+		}
+		delete(tempSpace.files, f)
+	}
+}
+
+/*
+ * os.Exit skips deferred calls - use this instead, so temp files do not outlive the process
+ */
+func Exit(code int) {
+	CleanupTempSpace()
+	os.Exit(code)
+}
@@ -0,0 +1,84 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+// no process can have this pid
+const deadPid = 1<<31 - 1
+
+func TestOwnerAlive(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signal 0 is not supported")
+	}
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{fmt.Sprintf(".snapshot-p%d-123.db", os.Getpid()), true},
+		{fmt.Sprintf(".snapshot-p%d-123.db", os.Getppid()), true},
+		{fmt.Sprintf(".snapshot-p%d-123.db", deadPid), false},
+		{".snapshot-123.db", false}, // before the temp space
+		{".snapshot-px-123.db", false},
+	} {
+		if got := ownerAlive(tc.name); got != tc.want {
+			t.Errorf("ownerAlive(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSweepStale(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signal 0 is not supported")
+	}
+	ts := &TempSpace{dir: t.TempDir(), files: make(map[string]bool)}
+	own, err := ts.createTemp(".snapshot-*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = own.Close()
+
+	var stale, kept []string
+	for _, name := range []string{
+		fmt.Sprintf(".snapshot-p%d-1.db", deadPid),
+		fmt.Sprintf(".oom-p%d-1.db", deadPid),
+		fmt.Sprintf("dump-20260101000000-gzip-p%d-1.sql.gz%s", deadPid, partialSuffix),
+		fmt.Sprintf(".chain-state-p%d-1.db", deadPid),
+		".export-1", // no owner tag
+	} {
+		stale = append(stale, filepath.Join(ts.dir, name))
+	}
+	for _, name := range []string{
+		fmt.Sprintf(".snapshot-p%d-2.db", os.Getppid()),               // of a live process
+		fmt.Sprintf("dump-20260101000000-gzip-p%d-1.sql.gz", deadPid), // a completed dump
+		"other.txt",
+	} {
+		kept = append(kept, filepath.Join(ts.dir, name))
+	}
+	for _, f := range append(append([]string(nil), stale...), kept...) {
+		if err := os.WriteFile(f, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := ts.sweepStale()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(removed)
+	sort.Strings(stale)
+	if !reflect.DeepEqual(removed, stale) {
+		t.Errorf("removed %v, want %v", removed, stale)
+	}
+	for _, f := range append(kept, own.Name()) {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("%s: %v", f, err)
+		}
+	}
+}
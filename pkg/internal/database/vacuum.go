@@ -0,0 +1,107 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+/*
+ * VACUUM INTO writes a compacted (defragmented) copy of MyDb into the - still empty - temp file, which is then opened
+ * read-only as snapshot db. whatever strategy is configured, a vacuumed snapshot is always file based.
+ * NOTE: VACUUM cannot run within a transaction. when verifying, the source digests are taken on the same connection
+ * right after the VACUUM INTO, which is held throughout - and PRAGMA data_version proves that no other connection
+ * committed in between, so both saw the same state of MyDb like within a single read transaction. a commit in between
+ * fails the attempt with ErrSnapshotSourceModified, i.e. it is retried.
+ */
+var vacuumIntoStrategy SnapshotStrategy = &vacuumStrategy{}
+
+type vacuumStrategy struct{}
+
+func (s *vacuumStrategy) Name() string {
+	return "vacuum"
+}
+
+func (s *vacuumStrategy) TempFilePattern() string {
+	return ".snapshot-vacuum-*.db"
+}
+
+func (s *vacuumStrategy) ConnStr(tempFile string) string {
+	return fmt.Sprintf("file:%s?mode=ro&immutable=1&cache=private&_query_only=true&_mutex=no", tempFile)
+}
+
+func (s *vacuumStrategy) ReaderConnStr(tempFile string) string {
+	return s.ConnStr(tempFile)
+}
+
+func (snap *Snapshot) vacuumInto(ctx context.Context, verify bool, progress ProgressFunc) ([]TableDigest, error) {
+	// VACUUM INTO refuses to overwrite a non-empty file, e.g. left behind by a failed attempt
+	err := os.Truncate(snap.tempFile, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	connCtx, cancel := context.WithTimeout(ctx, 4*time.Minute)
+	defer cancel()
+	conn, err := MyDb.Conn(connCtx)
+	if err != nil {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("failed to get driverConn - err: %+v", err) + "\n")
+		return nil, err
+	}
+	defer conn.Close()
+
+	var dataVersion int64
+	err = conn.QueryRowContext(ctx, "PRAGMA data_version").Scan(&dataVersion)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.ExecContext(ctx, "VACUUM INTO ?", snap.tempFile)
+	if err != nil {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("db snapshot: failed to vacuum into %s - err: %+v", snap.tempFile, err) + "\n")
+		return nil, err
+	}
+
+	size, pageSize, err := dbFileSize(snap.tempFile)
+	if err != nil {
+		return nil, err
+	}
+	progress.report(Progress{Phase: ProgressSnapshot, PagesCopied: int(size / int64(pageSize)), Done: true})
+
+	if !verify {
+		return nil, nil
+	}
+	digests, err := digestTables(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	var after int64
+	err = conn.QueryRowContext(ctx, "PRAGMA data_version").Scan(&after)
+	if err != nil {
+		return nil, err
+	}
+	if after != dataVersion {
+		return nil, ErrSnapshotSourceModified
+	}
+	return digests, nil
+}
+
+func dbFileSize(fileName string) (int64, int, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 100)
+	_, err = io.ReadFull(file, header)
+	if err != nil {
+		return 0, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	return info.Size(), sqliteDbPageSize(header), nil
+}
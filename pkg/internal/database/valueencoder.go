@@ -0,0 +1,111 @@
+package database
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+ * column affinity as derived from the declared type, see https://www.sqlite.org/datatype3.html#determination_of_column_affinity
+ */
+type Affinity string
+
+const AffinityInteger Affinity = "INTEGER"
+const AffinityText Affinity = "TEXT"
+const AffinityBlob Affinity = "BLOB"
+const AffinityReal Affinity = "REAL"
+const AffinityNumeric Affinity = "NUMERIC"
+
+func columnAffinity(declType string) Affinity {
+	t := strings.ToUpper(declType)
+	switch {
+	case strings.Contains(t, "INT"):
+		return AffinityInteger
+	case strings.Contains(t, "CHAR"), strings.Contains(t, "CLOB"), strings.Contains(t, "TEXT"):
+		return AffinityText
+	case strings.Contains(t, "BLOB"), t == "":
+		return AffinityBlob
+	case strings.Contains(t, "REAL"), strings.Contains(t, "FLOA"), strings.Contains(t, "DOUB"):
+		return AffinityReal
+	default:
+		return AffinityNumeric
+	}
+}
+
+/*
+ * appends the SQL literal of a value as scanned into an interface{} - the literal has the value's storage class, so
+ * inserting it into a column of the given affinity stores the very same value again:
+ * - NULL as NULL
+ * - INTEGER as decimal
+ * - REAL with full precision: 17 significant digits - sqlite's parser does not always get the shortest representation
+ *   back to the very same float64. outside REAL affinity columns an integral REAL keeps a fractional part, e.g. `2.0`,
+ *   so it does not turn into an INTEGER.
+ * - TEXT quoted, a NUL character - which a literal cannot contain - by casting its blob representation
+ * - BLOB as X'..'
+ */
+func appendValue(sb *strings.Builder, v interface{}, affinity Affinity) {
+	switch val := v.(type) {
+	case nil:
+		sb.WriteString("NULL")
+	case int64:
+		sb.WriteString(strconv.FormatInt(val, 10))
+	case float64:
+		appendReal(sb, val, affinity)
+	case []byte:
+		sb.WriteString("X'")
+		sb.WriteString(strings.ToUpper(hex.EncodeToString(val)))
+		sb.WriteString("'")
+	case string:
+		appendText(sb, val)
+	default:
+		// not to be expected when selecting raw values, see rawColumnList
+		appendText(sb, fmt.Sprint(val))
+	}
+}
+
+func appendReal(sb *strings.Builder, f float64, affinity Affinity) {
+	switch {
+	case math.IsInf(f, 1):
+		// sqlite has no literal for infinity, but any overflowing one evaluates to it
+		sb.WriteString("1e999")
+	case math.IsInf(f, -1):
+		sb.WriteString("-1e999")
+	default:
+		s := strconv.FormatFloat(f, 'g', 17, 64)
+		sb.WriteString(s)
+		if affinity != AffinityReal && !strings.ContainsAny(s, ".eE") {
+			sb.WriteString(".0")
+		}
+	}
+}
+
+func appendText(sb *strings.Builder, s string) {
+	if strings.IndexByte(s, 0) >= 0 {
+		sb.WriteString("CAST(X'")
+		sb.WriteString(strings.ToUpper(hex.EncodeToString([]byte(s))))
+		sb.WriteString("' AS TEXT)")
+		return
+	}
+	sb.WriteString("'")
+	sb.WriteString(strings.ReplaceAll(s, "'", "''"))
+	sb.WriteString("'")
+}
+
+func quoteIdent(name string) string {
+	return "\"" + strings.ReplaceAll(name, "\"", "\"\"") + "\""
+}
+
+/*
+ * select list returning each column's stored value as is: the unary + is a no-op in sqlite, but - other than a plain
+ * column reference - has no declared type, which would make the driver convert e.g. `date` columns into time.Time
+ */
+func rawColumnList(tableInfo *TableInfo) string {
+	cols := make([]string, 0, len(tableInfo.columnInfos))
+	for _, ci := range tableInfo.columnInfos {
+		cols = append(cols, "+"+quoteIdent(ci.colName))
+	}
+	return strings.Join(cols, ", ")
+}
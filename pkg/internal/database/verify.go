@@ -0,0 +1,316 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"gopkg.in/errgo.v2/errors"
+	"hash"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * optional verification of a freshly created snapshot:
+ * - quick: PRAGMA quick_check, full: PRAGMA integrity_check
+ * - PRAGMA foreign_key_check
+ * - row count and content hash per table, compared against the source db. the source side is computed within the
+ *   same read transaction the snapshot was copied in, so MyDb cannot change in between. NOTE: this read lock is held
+ *   for the whole copy, i.e. verification gives up the non-invasiveness of chunked backups.
+ */
+type VerifyMode string
+
+const VerifyOff VerifyMode = "off"
+const VerifyQuick VerifyMode = "quick"
+const VerifyFull VerifyMode = "full"
+
+func VerifyModeByName(name string) (VerifyMode, error) {
+	for _, m := range []VerifyMode{VerifyOff, VerifyQuick, VerifyFull} {
+		if strings.EqualFold(string(m), name) {
+			return m, nil
+		}
+	}
+	return "", errors.New(fmt.Sprintf("unknown verify mode %q - expected one of: off, quick, full", name))
+}
+
+type TableDigest struct {
+	Table string
+	Rows  int64
+	Hash  string // sha256 over all rows in primary key order
+}
+
+type TableVerification struct {
+	Table          string
+	SourceRows     int64
+	SnapshotRows   int64
+	SourceHash     string
+	SnapshotHash   string
+	MissingInOther bool // table only exists on one side
+}
+
+func (tv *TableVerification) Matches() bool {
+	return !tv.MissingInOther && tv.SourceRows == tv.SnapshotRows && tv.SourceHash == tv.SnapshotHash
+}
+
+type ForeignKeyViolation struct {
+	Table  string
+	RowId  sql.NullInt64 // NULL for WITHOUT ROWID tables
+	Parent string
+	FkId   int
+}
+
+type VerificationResult struct {
+	Mode                 VerifyMode
+	IntegrityErrors      []string
+	ForeignKeyViolations []ForeignKeyViolation
+	Tables               []TableVerification
+	Duration             time.Duration
+}
+
+func (r *VerificationResult) OK() bool {
+	return len(r.Mismatches()) == 0
+}
+
+// human readable findings - empty if the snapshot is a faithful copy
+func (r *VerificationResult) Mismatches() []string {
+	mismatches := make([]string, 0)
+	for _, e := range r.IntegrityErrors {
+		mismatches = append(mismatches, "integrity: "+e)
+	}
+	for _, v := range r.ForeignKeyViolations {
+		mismatches = append(mismatches, fmt.Sprintf("foreign key: %s(rowid=%v) -> %s (fk %d)", v.Table, v.RowId.Int64, v.Parent, v.FkId))
+	}
+	for _, tv := range r.Tables {
+		if tv.MissingInOther {
+			mismatches = append(mismatches, fmt.Sprintf("table %s: missing on one side", tv.Table))
+		} else if !tv.Matches() {
+			mismatches = append(mismatches, fmt.Sprintf("table %s: rows %d/%d, hash %.12s/%.12s (source/snapshot)",
+				tv.Table, tv.SourceRows, tv.SnapshotRows, tv.SourceHash, tv.SnapshotHash))
+		}
+	}
+	return mismatches
+}
+
+func (r *VerificationResult) String() string {
+	if r.OK() {
+		return fmt.Sprintf("verification(%s) ok: %d tables in %s", r.Mode, len(r.Tables), r.Duration.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("verification(%s) FAILED: %s", r.Mode, strings.Join(r.Mismatches(), "; "))
+}
+
+/*
+ * the snapshot differs from its source or is corrupt
+ */
+type VerificationError struct {
+	Result *VerificationResult
+}
+
+func (e *VerificationError) Error() string {
+	return "db snapshot " + e.Result.String()
+}
+
+/*
+ * checks the snapshot db against the digests of the source taken while copying it
+ */
+func verifySnapshot(ctx context.Context, snapshotDb queryer, mode VerifyMode, sourceDigests []TableDigest) (*VerificationResult, error) {
+	start := time.Now()
+	res := &VerificationResult{Mode: mode}
+	defer func() {
+		res.Duration = time.Since(start)
+	}()
+
+	checkPragma := "PRAGMA quick_check"
+	if mode == VerifyFull {
+		checkPragma = "PRAGMA integrity_check"
+	}
+	integrity, err := queryStrings(ctx, snapshotDb, checkPragma)
+	if err != nil {
+		return res, err
+	}
+	for _, line := range integrity {
+		if line != "ok" {
+			res.IntegrityErrors = append(res.IntegrityErrors, line)
+		}
+	}
+
+	res.ForeignKeyViolations, err = foreignKeyViolations(ctx, snapshotDb)
+	if err != nil {
+		return res, err
+	}
+
+	snapshotDigests, err := digestTables(ctx, snapshotDb)
+	if err != nil {
+		return res, err
+	}
+	res.Tables = compareDigests(sourceDigests, snapshotDigests)
+	return res, nil
+}
+
+func compareDigests(source []TableDigest, snapshot []TableDigest) []TableVerification {
+	byTable := make(map[string]*TableVerification)
+	for _, d := range source {
+		byTable[d.Table] = &TableVerification{Table: d.Table, SourceRows: d.Rows, SourceHash: d.Hash, MissingInOther: true}
+	}
+	for _, d := range snapshot {
+		tv, ok := byTable[d.Table]
+		if !ok {
+			tv = &TableVerification{Table: d.Table, MissingInOther: true}
+			byTable[d.Table] = tv
+		} else {
+			tv.MissingInOther = false
+		}
+		tv.SnapshotRows = d.Rows
+		tv.SnapshotHash = d.Hash
+	}
+
+	tables := make([]TableVerification, 0, len(byTable))
+	for _, tv := range byTable {
+		tables = append(tables, *tv)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Table < tables[j].Table })
+	return tables
+}
+
+func queryStrings(ctx context.Context, db queryer, stmt string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]string, 0, 1)
+	for rows.Next() {
+		var s string
+		err = rows.Scan(&s)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	return result, rows.Err()
+}
+
+func foreignKeyViolations(ctx context.Context, db queryer) ([]ForeignKeyViolation, error) {
+	rows, err := db.QueryContext(ctx, "PRAGMA foreign_key_check")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	violations := make([]ForeignKeyViolation, 0)
+	for rows.Next() {
+		var v ForeignKeyViolation
+		err = rows.Scan(&v.Table, &v.RowId, &v.Parent, &v.FkId)
+		if err != nil {
+			return nil, err
+		}
+		violations = append(violations, v)
+	}
+	return violations, rows.Err()
+}
+
+/*
+ * row count and content hash of every table - rows are hashed in primary key (resp. rowid) order, each value with its
+ * storage class, so e.g. integer 1 and text '1' differ
+ */
+func digestTables(ctx context.Context, db queryer) ([]TableDigest, error) {
+	tableNames, err := getTableNames(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	digests := make([]TableDigest, 0, len(tableNames))
+	for _, tableName := range tableNames {
+		tableInfo, err := getTableInfo(ctx, db, tableName)
+		if err != nil {
+			return nil, err
+		}
+		digest, err := digestTable(ctx, db, tableName, tableInfo)
+		if err != nil {
+			return nil, err
+		}
+		digests = append(digests, digest)
+	}
+	return digests, nil
+}
+
+func digestTable(ctx context.Context, db queryer, tableName string, tableInfo *TableInfo) (TableDigest, error) {
+	digest := TableDigest{Table: tableName}
+	rows, err := db.QueryContext(ctx, "SELECT "+rawColumnList(tableInfo)+" FROM "+quoteIdent(tableName)+" ORDER BY "+orderByPk(tableInfo))
+	if err != nil {
+		return digest, err
+	}
+	defer rows.Close()
+
+	h := sha256.New()
+	vals := make([]interface{}, len(tableInfo.columnInfos))
+	ptrs := make([]interface{}, len(vals))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	for rows.Next() {
+		err = rows.Scan(ptrs...)
+		if err != nil {
+			return digest, err
+		}
+		for _, v := range vals {
+			hashValue(h, v)
+		}
+		digest.Rows++
+	}
+	if err = rows.Err(); err != nil {
+		return digest, err
+	}
+	digest.Hash = hex.EncodeToString(h.Sum(nil))
+	return digest, nil
+}
+
+func orderByPk(tableInfo *TableInfo) string {
+	pkCols := make([]*ColumnInfo, 0, 2)
+	for _, ci := range tableInfo.columnInfos {
+		if ci.pk > 0 {
+			pkCols = append(pkCols, ci)
+		}
+	}
+	if len(pkCols) == 0 {
+		return "rowid"
+	}
+	sort.Slice(pkCols, func(i, j int) bool { return pkCols[i].pk < pkCols[j].pk })
+	names := make([]string, 0, len(pkCols))
+	for _, ci := range pkCols {
+		names = append(names, quoteIdent(ci.colName))
+	}
+	return strings.Join(names, ", ")
+}
+
+func hashValue(h hash.Hash, v interface{}) {
+	var buf [8]byte
+	switch val := v.(type) {
+	case nil:
+		_, _ = h.Write([]byte{'n'})
+	case int64:
+		binary.BigEndian.PutUint64(buf[:], uint64(val))
+		_, _ = h.Write([]byte{'i'})
+		_, _ = h.Write(buf[:])
+	case float64:
+		binary.BigEndian.PutUint64(buf[:], math.Float64bits(val))
+		_, _ = h.Write([]byte{'r'})
+		_, _ = h.Write(buf[:])
+	case []byte:
+		binary.BigEndian.PutUint64(buf[:], uint64(len(val)))
+		_, _ = h.Write([]byte{'b'})
+		_, _ = h.Write(buf[:])
+		_, _ = h.Write(val)
+	default:
+		s := fmt.Sprint(val)
+		binary.BigEndian.PutUint64(buf[:], uint64(len(s)))
+		_, _ = h.Write([]byte{'t'})
+		_, _ = h.Write(buf[:])
+		_, _ = h.Write([]byte(s))
+	}
+}
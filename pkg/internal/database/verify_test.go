@@ -0,0 +1,85 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+ * a copy of MyDb tampered with after the source digests were taken is told apart from a faithful one
+ */
+func TestVerifySnapshot(t *testing.T) {
+	ctx := context.Background()
+	sourceDigests, err := digestTables(ctx, MyDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range []struct {
+		name     string
+		tamper   string
+		mismatch string // expected in the VerificationError, "" for a faithful copy
+	}{
+		{"faithful", "", ""},
+		{"changed row", "UPDATE t10 SET t10f2 = 'tampered' WHERE id = (SELECT min(id) FROM t10)", "table t10: rows"},
+		{"added row", "INSERT INTO t6 (t5_id, t6f1, t6f2) SELECT t5_id, '2099-01-01', 0 FROM t6 LIMIT 1", "table t6: rows"},
+		{"dropped table", "DROP TABLE t11", "table t11: missing"},
+		{"deleted parent", "DELETE FROM t10 WHERE id IN (SELECT t10_id FROM t11)", "foreign key: t11"},
+	} {
+		copyFile := filepath.Join(t.TempDir(), "copy.db")
+		_, err = MyDb.ExecContext(ctx, "VACUUM INTO ?", copyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copyDb, err := sql.Open("sqlite3", "file:"+copyFile+"?mode=rw")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.tamper != "" {
+			mustExec(copyDb, tc.tamper)
+		}
+		mode := []VerifyMode{VerifyQuick, VerifyFull}[i%2]
+		res, err := verifySnapshot(ctx, copyDb, mode, sourceDigests)
+		_ = copyDb.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if tc.mismatch == "" {
+			if !res.OK() {
+				t.Errorf("%s: %s", tc.name, res)
+			}
+			continue
+		}
+		verErr := &VerificationError{Result: res}
+		if res.OK() || !strings.Contains(verErr.Error(), tc.mismatch) {
+			t.Errorf("%s: got %q, want a mismatch %q", tc.name, verErr.Error(), tc.mismatch)
+		}
+	}
+
+	opts := DefaultActivityOptions()
+	opts.Verify = VerifyFull
+	snap, err := OpenSnapshot(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	if v := snap.Verification(); v == nil || !v.OK() || len(v.Tables) == 0 {
+		t.Errorf("snapshot verification: %v", v)
+	}
+
+	// the source digests of a vacuumed copy stem from the state VACUUM INTO saw
+	opts.CopyMethod = CopyVacuumInto
+	res, err := Activity(ctx, ActivityNone, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := res.Verification; v == nil || !v.OK() || len(v.Tables) == 0 {
+		t.Errorf("vacuumed snapshot verification: %v", v)
+	}
+	if !strings.Contains(res.String(), "strategy=vacuum(overrides:memory)") {
+		t.Errorf("strategy override not reported: %s", res)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sthielo/go-sqlite-memleak/pkg/internal/database"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnvHttpAddr overrides the control server's listen address DefaultHttpAddr, "off" disables the server
+const EnvHttpAddr = "OOM_HTTP_ADDR"
+const DefaultHttpAddr = "localhost:8890"
+
+// how long running requests (e.g. a streaming dump) get to finish when the server shuts down
+const httpShutdownTimeout = 5 * time.Second
+
+/*
+ * the http counterpart of the command loop - the way production drives activities:
+ *   GET  /dumpdb?format=sql|csv|jsonl&codec=<codec>&include=<patterns>&exclude=<patterns>&where=<table>:<predicate>
+ *                                      streams a dump of a fresh snapshot as response body, Content-Encoding as of the
+ *                                      codec (see database.CodecByName), filtered as of queryFilter
+ *   POST /snapshot                     snapshot only, responds with the activity result
+ *   GET  /status                       json, see controlStatus
+ *   POST /shutdown                     ends the process like `END`
+ */
+type controlServer struct {
+	srv      *http.Server
+	shutdown context.CancelFunc // ends the command loop
+}
+
+func startControlServer(ctx context.Context, shutdown context.CancelFunc) (*controlServer, error) {
+	addr := os.Getenv(EnvHttpAddr)
+	if addr == "" {
+		addr = DefaultHttpAddr
+	}
+	if strings.EqualFold(addr, "off") {
+		return nil, nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cs := newControlServer(ctx, shutdown)
+	go func() {
+		err := cs.srv.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("http control server failed - err: %+v", err) + "\n")
+		}
+	}()
+	_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("http control server listening on %s", listener.Addr()) + "\n")
+	return cs, nil
+}
+
+// not yet serving
+func newControlServer(ctx context.Context, shutdown context.CancelFunc) *controlServer {
+	cs := &controlServer{shutdown: shutdown}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dumpdb", cs.handleDumpDb)
+	mux.HandleFunc("/snapshot", cs.handleSnapshot)
+	mux.HandleFunc("/status", cs.handleStatus)
+	mux.HandleFunc("/shutdown", cs.handleShutdown)
+	// requests get cancelled along with the process, e.g. on SIGINT
+	cs.srv = &http.Server{Handler: mux, BaseContext: func(net.Listener) context.Context { return ctx }}
+	return cs
+}
+
+func (cs *controlServer) stop() {
+	if cs == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	err := cs.srv.Shutdown(ctx)
+	if err != nil {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("http control server shutdown - err: %+v", err) + "\n")
+	}
+}
+
+// content type and file name extension of the (decoded) /dumpdb response body
+var dumpContentTypes = map[database.DumpFormat][2]string{
+	database.FormatSql:   {"application/sql", ".sql"},
+	database.FormatCsv:   {"application/x-tar", ".csv.tar"},
+	database.FormatJsonl: {"application/x-ndjson", ".jsonl"},
+}
+
+func (cs *controlServer) handleDumpDb(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	opts := currentActivityOpts()
+	if name := r.URL.Query().Get("format"); name != "" {
+		format, err := database.DumpFormatByName(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.Format = format
+	}
+	if name := r.URL.Query().Get("codec"); name != "" {
+		codec, err := database.CodecByName(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.Codec = codec
+	}
+	if filter, ok := queryFilter(r.URL.Query()); ok {
+		opts.Filter = filter
+	}
+
+	// headers go out with the first byte of the dump - until then a failing snapshot can still be answered properly
+	rw := &dumpResponseWriter{w: w, header: func(h http.Header) {
+		contentType := dumpContentTypes[opts.Format]
+		h.Set("Content-Type", contentType[0])
+		if encoding := opts.Codec.ContentEncoding(); encoding != "" {
+			h.Set("Content-Encoding", encoding)
+		}
+		h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"dump-%s%s\"", time.Now().Format("20060102150405"), contentType[1]))
+	}}
+	at := time.Now()
+	done := status.begin(database.ActivityStream)
+	res, err := database.StreamDump(r.Context(), rw, opts)
+	done()
+	reportHttpOutcome(database.ActivityStream, at, res, err)
+	if err == nil {
+		return
+	}
+	if rw.started {
+		// too late for an error status - make sure the client does not take the truncated body as complete
+		panic(http.ErrAbortHandler)
+	}
+	activityErrorResponse(w, err)
+}
+
+func (cs *controlServer) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	at := time.Now()
+	done := status.begin(database.ActivityNone)
+	res, err := database.Activity(r.Context(), database.ActivityNone, currentActivityOpts())
+	done()
+	reportHttpOutcome(database.ActivityNone, at, res, err)
+	if err != nil {
+		activityErrorResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = fmt.Fprintln(w, res)
+}
+
+func (cs *controlServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	body, err := json.MarshalIndent(status.snapshot(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+func (cs *controlServer) handleShutdown(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = fmt.Fprintln(w, "shutting down")
+	_, _ = os.Stdout.WriteString(">>> oom: " + "shutdown requested via http" + "\n")
+	cs.shutdown()
+}
+
+/*
+ * `include=t1,t6*`, `exclude=t10` and `where=t6:t6f1 >= '2022-01-05'` (repeatable) replace the configured filter
+ */
+func queryFilter(query url.Values) (*database.DumpFilter, bool) {
+	if query.Get("include") == "" && query.Get("exclude") == "" && len(query["where"]) == 0 {
+		return nil, false
+	}
+	filter := &database.DumpFilter{Where: make(map[string]string)}
+	if include := query.Get("include"); include != "" {
+		filter.Include = strings.Split(include, ",")
+	}
+	if exclude := query.Get("exclude"); exclude != "" {
+		filter.Exclude = strings.Split(exclude, ",")
+	}
+	for _, where := range query["where"] {
+		i := strings.IndexByte(where, ':')
+		if i < 0 {
+			filter.Where[where] = "" // rejected as empty predicate
+			continue
+		}
+		filter.Where[where[:i]] = where[i+1:]
+	}
+	return filter, true
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, fmt.Sprintf("method %s not allowed - expected: %s", r.Method, method), http.StatusMethodNotAllowed)
+	return false
+}
+
+/*
+ * a failed snapshot (after retries) is the server being busy, not broken - a filter or masking not fitting the db the
+ * client's fault
+ */
+func activityErrorResponse(w http.ResponseWriter, err error) {
+	var snapErr *database.SnapshotError
+	if errors.As(err, &snapErr) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	var filterErr *database.DumpFilterError
+	if errors.As(err, &filterErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var maskErr *database.MaskingError
+	if errors.As(err, &maskErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// unlike command outcomes, a failed http activity is never fatal - the client got told
+func reportHttpOutcome(cmd string, at time.Time, res *database.ActivityResult, err error) {
+	outcomes <- database.ActivityOutcome{Origin: database.OriginHttp, Cmd: cmd, At: at, Result: res, Err: err}
+}
+
+type dumpResponseWriter struct {
+	w       http.ResponseWriter
+	header  func(h http.Header)
+	started bool
+}
+
+func (dw *dumpResponseWriter) Write(p []byte) (int, error) {
+	if !dw.started {
+		dw.started = true
+		dw.header(dw.w.Header())
+		dw.w.WriteHeader(http.StatusOK)
+	}
+	return dw.w.Write(p)
+}
+
+var status = &controlStatus{StartedAt: time.Now(), Pid: os.Getpid(), running: make(map[int]runningActivity)}
+
+/*
+ * what GET /status reports
+ */
+type controlStatus struct {
+	mu      sync.Mutex
+	running map[int]runningActivity
+	nextId  int
+
+	StartedAt   time.Time         `json:"startedAt"`
+	Pid         int               `json:"pid"`
+	Rss         int64             `json:"rss"` // bytes, -1 if unknown
+	TempDir     string            `json:"tempDir"`
+	Options     statusOptions     `json:"options"`
+	Running     []runningActivity `json:"running"`
+	LastOutcome *statusOutcome    `json:"lastOutcome,omitempty"`
+}
+
+type runningActivity struct {
+	Cmd   string    `json:"cmd"`
+	Since time.Time `json:"since"`
+}
+
+type statusOptions struct {
+	Strategy    string `json:"strategy"`
+	CopyMethod  string `json:"copy"`
+	Format      string `json:"format"`
+	Codec       string `json:"codec"`
+	Workers     int    `json:"dumpWorkers"`
+	Verify      string `json:"verify"`
+	Shared      bool   `json:"shared"`
+	Incremental bool   `json:"incremental"`
+	Filter      string `json:"filter,omitempty"`
+	Masking     string `json:"masking,omitempty"`
+}
+
+type statusOutcome struct {
+	Origin string    `json:"origin"`
+	Cmd    string    `json:"cmd"`
+	At     time.Time `json:"at"`
+	Result string    `json:"result,omitempty"`
+	Err    string    `json:"err,omitempty"`
+}
+
+// returns the func to call once the activity is done
+func (s *controlStatus) begin(cmd string) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.nextId
+	s.nextId++
+	s.running[id] = runningActivity{Cmd: cmd, Since: time.Now()}
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.running, id)
+	}
+}
+
+func (s *controlStatus) record(outcome database.ActivityOutcome) {
+	if outcome.Skipped {
+		return
+	}
+	o := &statusOutcome{Origin: outcome.Origin, Cmd: outcome.Cmd, At: outcome.At}
+	if outcome.Result != nil {
+		o.Result = outcome.Result.String()
+	}
+	if outcome.Err != nil {
+		o.Err = outcome.Err.Error()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.LastOutcome = o
+}
+
+func (s *controlStatus) snapshot() *controlStatus {
+	opts := currentActivityOpts()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := &controlStatus{StartedAt: s.StartedAt, Pid: s.Pid, Rss: database.ProcessRss(), TempDir: database.TempDir(), LastOutcome: s.LastOutcome}
+	snap.Options = statusOptions{Strategy: opts.Strategy.Name(), CopyMethod: string(opts.CopyMethod), Format: string(opts.Format), Codec: opts.Codec.Name(), Workers: opts.DumpWorkers,
+		Verify: string(opts.Verify), Shared: opts.Snapshots != nil, Incremental: opts.Chain != nil, Filter: opts.Filter.String(),
+		Masking: opts.Masking.String()}
+	snap.Running = make([]runningActivity, 0, len(s.running))
+	for _, a := range s.running {
+		snap.Running = append(snap.Running, a)
+	}
+	sort.Slice(snap.Running, func(i, j int) bool { return snap.Running[i].Since.Before(snap.Running[j].Since) })
+	return snap
+}
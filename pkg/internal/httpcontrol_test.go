@@ -0,0 +1,253 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/sthielo/go-sqlite-memleak/pkg/internal/database"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ * the control server's handlers on an empty db with the real schema - outcomes are recorded, not reported
+ */
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "oom-http-test-")
+	if err != nil {
+		panic(err)
+	}
+	_, err = database.InitTempSpace(dir)
+	if err != nil {
+		panic(err)
+	}
+	database.InitDB()
+	_, err = database.MyDb.Exec("INSERT INTO t10 (id, t10f1, t10f2) VALUES ('00000001-0000-4000-8000-000000000001', 'a', 'b')")
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		for outcome := range outcomes {
+			status.record(outcome)
+		}
+	}()
+
+	code := m.Run()
+
+	_ = database.CloseMyDb()
+	database.CleanupTempSpace()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// serves cs on a local port - ctx as the server's base context
+func startTestServer(t *testing.T, ctx context.Context) *httptest.Server {
+	cs := newControlServer(ctx, func() {})
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = cs.srv
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// changes activityOpts for the test only
+func setActivityOpts(t *testing.T, change func(opts *database.ActivityOptions)) {
+	activityOptsMu.Lock()
+	prev := *activityOpts
+	change(activityOpts)
+	activityOptsMu.Unlock()
+	t.Cleanup(func() {
+		activityOptsMu.Lock()
+		*activityOpts = prev
+		activityOptsMu.Unlock()
+	})
+}
+
+func TestDumpDbHttp(t *testing.T) {
+	ts := startTestServer(t, context.Background())
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/dumpdb?codec=gzip", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip") // keeps the client from decoding the body itself
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("Content-Type") != "application/sql" {
+		t.Fatalf("got %s, Content-Encoding %q, Content-Type %q", resp.Status, resp.Header.Get("Content-Encoding"), resp.Header.Get("Content-Type"))
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "INSERT INTO \"t10\"") || !strings.HasSuffix(string(body), "COMMIT;\n") {
+		t.Errorf("not a complete dump:\n%s", body)
+	}
+
+	resp, err = http.Get(ts.URL + "/dumpdb?codec=none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("uncompressed dump: got %s, Content-Encoding %q", resp.Status, resp.Header.Get("Content-Encoding"))
+	}
+}
+
+/*
+ * a filter or masking not fitting the db is the client's fault
+ */
+func TestDumpDbHttpBadRequest(t *testing.T) {
+	ts := startTestServer(t, context.Background())
+	for _, query := range []string{"format=nosuch", "codec=nosuch", "where=t6:nosuch%20=%201", "include=t%5B"} {
+		resp, err := http.Get(ts.URL + "/dumpdb?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: got %s, want 400", query, resp.Status)
+		}
+	}
+
+	setActivityOpts(t, func(opts *database.ActivityOptions) {
+		opts.Masking = &database.Masking{Salt: "s", Rules: []database.MaskRule{{Table: "t1", Column: "nosuch", Method: database.MaskRedact}}}
+	})
+	resp, err := http.Get(ts.URL + "/dumpdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid masking: got %s, want 400", resp.Status)
+	}
+}
+
+func TestActivityErrorResponse(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{&database.SnapshotError{Attempts: 3, Reason: "max attempts", Err: database.ErrSnapshotSourceModified}, http.StatusServiceUnavailable},
+		{context.Canceled, http.StatusServiceUnavailable},
+		{&database.DumpFilterError{Table: "t6", Err: errors.New("no such column")}, http.StatusBadRequest},
+		{&database.MaskingError{Rule: "t1.x=redact", Err: errors.New("no such column")}, http.StatusBadRequest},
+		{errors.New("disk full"), http.StatusInternalServerError},
+	} {
+		w := httptest.NewRecorder()
+		activityErrorResponse(w, tc.err)
+		if w.Code != tc.want {
+			t.Errorf("%v: got %d, want %d", tc.err, w.Code, tc.want)
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	ts := startTestServer(t, context.Background())
+	for _, tc := range []struct{ method, path, allow string }{
+		{http.MethodPost, "/dumpdb", http.MethodGet},
+		{http.MethodGet, "/snapshot", http.MethodPost},
+		{http.MethodPost, "/status", http.MethodGet},
+		{http.MethodGet, "/shutdown", http.MethodPost},
+	} {
+		req, err := http.NewRequest(tc.method, ts.URL+tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != tc.allow {
+			t.Errorf("%s %s: got %s, Allow %q", tc.method, tc.path, resp.Status, resp.Header.Get("Allow"))
+		}
+	}
+}
+
+/*
+ * a dump failing after its first bytes went out cannot tell by its status - the response is aborted instead, so the
+ * client does not take the truncated body as complete
+ */
+func TestDumpDbHttpAborted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts := startTestServer(t, ctx)
+	setActivityOpts(t, func(opts *database.ActivityOptions) {
+		opts.Codec = database.CodecNone
+		opts.Progress = func(p database.Progress) {
+			if p.Phase == database.ProgressDump {
+				cancel() // the dump of the first table is done, the second one fails
+			}
+		}
+	})
+
+	resp, err := http.Get(ts.URL + "/dumpdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %s, want 200 as sent before the failure", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Errorf("aborted dump read completely:\n%s", body)
+	}
+}
+
+func TestStatusHttp(t *testing.T) {
+	ts := startTestServer(t, context.Background())
+	setActivityOpts(t, func(opts *database.ActivityOptions) {
+		opts.Filter = &database.DumpFilter{Include: []string{"t1"}}
+	})
+	before := time.Now()
+	resp, err := http.Post(ts.URL+"/snapshot", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("snapshot: got %s", resp.Status)
+	}
+
+	var got controlStatus
+	for deadline := time.Now().Add(time.Second); ; {
+		resp, err = http.Get(ts.URL + "/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type %q", ct)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&got)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the outcome is recorded asynchronously
+		if got.LastOutcome != nil && !got.LastOutcome.At.Before(before) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got.Pid != os.Getpid() || got.TempDir != database.TempDir() || got.Options.Filter != "include=t1" || len(got.Running) != 0 {
+		t.Errorf("status pid %d, tempDir %q, options %+v, running %v", got.Pid, got.TempDir, got.Options, got.Running)
+	}
+	if got.LastOutcome == nil || got.LastOutcome.Origin != database.OriginHttp || got.LastOutcome.Cmd != database.ActivityNone || got.LastOutcome.Err != "" {
+		t.Errorf("last outcome %+v", got.LastOutcome)
+	}
+}
@@ -1,50 +1,568 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/sthielo/go-sqlite-memleak/pkg/internal/database"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+var stdin = bufio.NewScanner(os.Stdin)
+
+// options applied to every activity - adjusted by the `SET <option> <value>` command
+var activityOpts = database.DefaultActivityOptions()
+var activityOptsMu sync.Mutex // SET vs. http requests reading activityOpts
+
+// used for activityOpts.Snapshots after `SET shared on`
+var sharedSnapshots = database.NewSnapshotManager(currentActivityOpts, 0)
+
+// used for activityOpts.Chain after `SET incremental on` - off and on again continues the chain
+var dumpChain = database.NewDumpChain()
+
+// salt of activityOpts.Masking, unless set by `SET masksalt` - a random one per process if not set
+const EnvMaskSalt = "OOM_MASK_SALT"
+
+// outcomes of activities run by the command loop and by the scheduler - see reportOutcomes
+var outcomes = make(chan database.ActivityOutcome)
+var commandOutcomeReported = make(chan struct{})
+
+// how long a running activity may take to wind down after SIGINT/SIGTERM
+const signalGracePeriod = 5 * time.Second
+
+// set by `SCHEDULE ...`
+var scheduler *database.Scheduler
+
 func main() {
+	activityOpts.Progress = reportProgress
+
+	// SIGINT/SIGTERM aborts a running activity (cleaning up its temp files) and ends the command loop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// ... as does `POST /shutdown`
+	ctx, shutdown := context.WithCancel(ctx)
+	defer shutdown()
+	done := make(chan struct{})
+	defer close(done)
+	go exitOnSignal(done)
+
+	stale, err := database.InitTempSpace("")
+	if err != nil {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("cannot set up temp dir - err: %+v", err) + "\n")
+		os.Exit(1)
+	}
+	for _, f := range stale {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("removed stale temp file %s", f) + "\n")
+	}
+	defer database.CleanupTempSpace()
+	defer sharedSnapshots.Close()
+
 	database.InitDB()
-	defer database.MyDb.Close()
+	// MyDb as of exit, not as of now
+	defer func() { _ = database.CloseMyDb() }()
 	database.FillInDummyData()
 
+	go reportOutcomes()
+	defer stopScheduler()
+
+	// stdin drives the testee anyway - e.g. a second one finding the address taken still runs
+	controlServer, err := startControlServer(ctx, shutdown)
+	if err != nil {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("cannot start http control server, carrying on without - err: %+v", err) + "\n")
+	}
+	defer controlServer.stop()
+
 	_, _ = os.Stdout.WriteString("DONE\n")
 
-	cmd := waitInput() // wait 'END' or 'CONTINUE'/'DUMP' or 'SNAPSHOT' (any input) - give time to gather process stats
-	for i := 0; cmd != "END" && i < 30; i++ {
+	inputs := readInputs()
+	cmd, args := waitInput(ctx, inputs) // wait 'END' or 'CONTINUE'/'DUMP' or 'SNAPSHOT' or 'SET' or 'SCHEDULE' or 'LOAD' (any input) - give time to gather process stats
+	for i := 0; cmd != "END" && i < 30 && ctx.Err() == nil; i++ {
 
 		if cmd == "CONTINUE" || cmd == "DUMP" {
-			dumpDb()
+			dumpDb(ctx)
 		} else if cmd == "SNAPSHOT" {
-			snapshotOnly()
+			snapshotOnly(ctx)
+		} else if cmd == "SET" {
+			setOption(args)
+		} else if cmd == "SCHEDULE" {
+			schedule(ctx, args)
+		} else if cmd == "LOAD" {
+			load(ctx, args)
+		}
+
+		_, _ = os.Stdout.WriteString(fmt.Sprintf("DONE iteration %d\n", i))
+		cmd, args = waitInput(ctx, inputs)
+	}
+}
+
+/*
+ * the command loop only notices a signal once stdin delivers the next command - if it did not wind down after a grace
+ * period, exit anyway, but without leaving temp files behind
+ */
+func exitOnSignal(done <-chan struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-done:
+		return
+	case sig := <-sigs:
+		select {
+		case <-done:
+		case <-time.After(signalGracePeriod):
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("exiting on %v", sig) + "\n")
+			database.Exit(1)
+		}
+	}
+}
+
+func dumpDb(ctx context.Context) {
+	runActivity(ctx, database.ActivityDump)
+}
+
+func snapshotOnly(ctx context.Context) {
+	runActivity(ctx, database.ActivityNone)
+}
+
+// returns once the outcome got reported, so it precedes the `DONE iteration` line
+func runActivity(ctx context.Context, cmd string) {
+	at := time.Now()
+	done := status.begin(cmd)
+	res, err := database.Activity(ctx, cmd, currentActivityOpts())
+	done()
+	outcomes <- database.ActivityOutcome{Origin: database.OriginCommand, Cmd: cmd, At: at, Result: res, Err: err}
+	<-commandOutcomeReported
+}
+
+func reportOutcomes() {
+	for outcome := range outcomes {
+		status.record(outcome)
+		// only a failed command ends the process - a failed background run is reported, the next one may succeed
+		if outcome.Skipped || (outcome.Origin != database.OriginCommand && outcome.Err != nil) {
+			_, _ = os.Stdout.WriteString(">>> oom: " + outcome.String() + "\n")
+		} else {
+			if outcome.Result != nil {
+				_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("activity result (%s): %s", outcome.Origin, outcome.Result) + "\n")
+			}
+			handleActivityErr(outcome.Err)
+		}
+		if outcome.Origin == database.OriginCommand {
+			commandOutcomeReported <- struct{}{}
+		}
+	}
+}
+
+/*
+ * a failed snapshot (after retries) or a cancelled activity only skips the current iteration, any other error of a
+ * command is still fatal
+ */
+func handleActivityErr(err error) {
+	if err == nil {
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("activity cancelled: %+v\n", err) + "\n")
+		return
+	}
+	var snapErr *database.SnapshotError
+	if errors.As(err, &snapErr) {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("giving up on db snapshot: %+v\n", err) + "\n")
+		return
+	}
+	var filterErr *database.DumpFilterError
+	if errors.As(err, &filterErr) {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("skipping dump: %+v\n", err) + "\n")
+		return
+	}
+	var maskErr *database.MaskingError
+	if errors.As(err, &maskErr) {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("skipping dump: %+v\n", err) + "\n")
+		return
+	}
+	_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("error when dumping db: %+v\n", err) + "\n")
+	database.Exit(1)
+}
+
+/*
+ * progress protocol on stdout, e.g. `PROGRESS snapshot pages=1250 remaining=98750 done=false` - lets the test harness
+ * record how far an iteration got
+ */
+func reportProgress(p database.Progress) {
+	_, _ = os.Stdout.WriteString("PROGRESS " + p.String() + "\n")
+}
+
+/*
+ * e.g. `SET strategy tempfile`, `SET stepping adaptive`, `SET steptarget 2ms` - invalid settings are reported and
+ * ignored
+ */
+func setOption(args []string) {
+	if len(args) > 0 && strings.EqualFold(args[0], "where") {
+		setWhere(args[1:])
+		return
+	}
+	if len(args) > 0 && strings.EqualFold(args[0], "mask") {
+		setMask(args[1:])
+		return
+	}
+	if len(args) != 2 {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("invalid SET command %v - expected: SET <option> <value>", args) + "\n")
+		return
+	}
+	option, value := strings.ToLower(args[0]), args[1]
+	activityOptsMu.Lock()
+	defer activityOptsMu.Unlock()
+	switch option {
+	case "strategy":
+		strategy, err := database.SnapshotStrategyByName(value)
+		if err != nil {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("%+v", err) + "\n")
+			return
+		}
+		activityOpts.Strategy = strategy
+	case "copy":
+		copyMethod, err := database.SnapshotCopyMethodByName(value)
+		if err != nil {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("%+v", err) + "\n")
+			return
+		}
+		activityOpts.CopyMethod = copyMethod
+	case "stepping":
+		switch strings.ToLower(value) {
+		case "fixed":
+			activityOpts.Stepping.Adaptive = false
+		case "adaptive":
+			activityOpts.Stepping.Adaptive = true
+		default:
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("invalid stepping %q - expected: fixed, adaptive", value) + "\n")
+			return
+		}
+	case "steppages":
+		pages, err := strconv.Atoi(value)
+		if err != nil || pages < 1 {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("invalid page count %q", value) + "\n")
+			return
+		}
+		activityOpts.Stepping.Pages = pages
+	case "insertrows", "insertbytes", "commitevery", "dumpworkers":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("invalid number %q", value) + "\n")
+			return
+		}
+		switch option {
+		case "insertrows":
+			activityOpts.SqlDump.RowsPerInsert = n
+		case "insertbytes":
+			activityOpts.SqlDump.MaxInsertBytes = n
+		case "dumpworkers":
+			activityOpts.DumpWorkers = n
+		default:
+			activityOpts.SqlDump.CommitEvery = n
 		}
+	case "format":
+		format, err := database.DumpFormatByName(value)
+		if err != nil {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("%+v", err) + "\n")
+			return
+		}
+		if activityOpts.Chain != nil && format != database.FormatSql {
+			_, _ = os.Stdout.WriteString(">>> oom: " + "incremental dumps are sql only - SET incremental off first" + "\n")
+			return
+		}
+		activityOpts.Format = format
+	case "codec":
+		codec, err := database.CodecByName(value)
+		if err != nil {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("%+v", err) + "\n")
+			return
+		}
+		activityOpts.Codec = codec
+	case "verify":
+		mode, err := database.VerifyModeByName(value)
+		if err != nil {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("%+v", err) + "\n")
+			return
+		}
+		activityOpts.Verify = mode
+	case "shared":
+		switch strings.ToLower(value) {
+		case "on":
+			activityOpts.Snapshots = sharedSnapshots
+		case "off":
+			activityOpts.Snapshots = nil
+		default:
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("invalid shared %q - expected: on, off", value) + "\n")
+			return
+		}
+	case "incremental":
+		switch strings.ToLower(value) {
+		case "on":
+			if activityOpts.Format != database.FormatSql {
+				_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("incremental dumps are sql only, not %s", activityOpts.Format) + "\n")
+				return
+			}
+			activityOpts.Chain = dumpChain
+		case "off":
+			activityOpts.Chain = nil
+		default:
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("invalid incremental %q - expected: on, off", value) + "\n")
+			return
+		}
+	case "include", "exclude":
+		// comma separated table patterns, `-` for none
+		var patterns []string
+		if value != "-" {
+			patterns = strings.Split(value, ",")
+		}
+		filter := copyFilter(activityOpts.Filter)
+		if option == "include" {
+			filter.Include = patterns
+		} else {
+			filter.Exclude = patterns
+		}
+		activityOpts.Filter = filter
+	case "masksalt":
+		masking := copyMasking(activityOpts.Masking)
+		masking.Salt = value
+		activityOpts.Masking = masking
+		// keeps the salt out of the logs
+		_, _ = os.Stdout.WriteString(">>> oom: " + "set masksalt" + "\n")
+		return
+	case "maxage":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("invalid duration %q", value) + "\n")
+			return
+		}
+		sharedSnapshots.SetMaxAge(d)
+	case "steptarget", "steppause":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("invalid duration %q", value) + "\n")
+			return
+		}
+		if option == "steptarget" {
+			activityOpts.Stepping.TargetLatency = d
+		} else {
+			activityOpts.Stepping.Pause = d
+		}
+	default:
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("unknown option %q", option) + "\n")
+		return
+	}
+	_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("set %s=%s", option, value) + "\n")
+}
+
+/*
+ * `SET where <table> <predicate>`, e.g. `SET where t6 t6f1 >= '2022-01-05'`, dumps only the matching rows of the table,
+ * `SET where <table>` all of them again - either replaces a predicate set before for the table, whatever case its name
+ * was given in. the predicate is checked along with the next dump.
+ * NOTE: the words of the predicate get joined by single spaces
+ */
+func setWhere(args []string) {
+	if len(args) == 0 {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("invalid SET where command %v - expected: SET where <table> [<predicate>]", args) + "\n")
+		return
+	}
+	table, where := args[0], strings.Join(args[1:], " ")
+	activityOptsMu.Lock()
+	defer activityOptsMu.Unlock()
+	filter := copyFilter(activityOpts.Filter)
+	for other := range filter.Where {
+		if strings.EqualFold(other, table) { // a table name regardless of case, like sqlite's
+			delete(filter.Where, other)
+		}
+	}
+	if where != "" {
+		filter.Where[table] = where
+	}
+	activityOpts.Filter = filter
+	_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("set where %s=%s", table, where) + "\n")
+}
+
+// activities in flight (e.g. scheduled ones) keep the filter they started with
+func copyFilter(filter *database.DumpFilter) *database.DumpFilter {
+	c := &database.DumpFilter{Where: make(map[string]string)}
+	if filter != nil {
+		c.Include, c.Exclude = filter.Include, filter.Exclude
+		for table, where := range filter.Where {
+			c.Where[table] = where
+		}
+	}
+	return c
+}
+
+/*
+ * `SET mask <table>.<column> <method>`, e.g. `SET mask t1.t1f1 hash` or `SET mask t3.t3f2 truncate-8` (see
+ * database.NewMaskRule), masks the column in every dump, `SET mask <table>.<column> off` drops the rule. rules not
+ * fitting the db are reported along with the next dump.
+ */
+func setMask(args []string) {
+	dot := -1
+	if len(args) == 2 {
+		dot = strings.IndexByte(args[0], '.')
+	}
+	if dot < 0 {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("invalid SET mask command %v - expected: SET mask <table>.<column> <method|off>", args) + "\n")
+		return
+	}
+	table, column, method := args[0][:dot], args[0][dot+1:], args[1]
+	var rule database.MaskRule
+	if !strings.EqualFold(method, "off") {
+		var err error
+		rule, err = database.NewMaskRule(table, column, method)
+		if err != nil {
+			_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("%+v", err) + "\n")
+			return
+		}
+	}
+	activityOptsMu.Lock()
+	defer activityOptsMu.Unlock()
+	masking := copyMasking(activityOpts.Masking)
+	rules := masking.Rules[:0]
+	for _, r := range masking.Rules {
+		if !strings.EqualFold(r.Table, table) || !strings.EqualFold(r.Column, column) {
+			rules = append(rules, r)
+		}
+	}
+	if rule.Method != "" {
+		rules = append(rules, rule)
+	}
+	masking.Rules = rules
+	activityOpts.Masking = masking
+	_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("set mask %s.%s=%s", table, column, method) + "\n")
+}
 
-		_, _ = os.Stdout.WriteString(fmt.Sprintf("DONE iteration %d\n"))
-		cmd = waitInput()
+// like copyFilter - the first one gets its salt from EnvMaskSalt
+func copyMasking(masking *database.Masking) *database.Masking {
+	if masking == nil {
+		return &database.Masking{Salt: initialMaskSalt()}
 	}
+	return &database.Masking{Salt: masking.Salt, Rules: append([]database.MaskRule(nil), masking.Rules...)}
 }
 
-func dumpDb() {
-	err := database.Activity(database.ActivityDump)
+func initialMaskSalt() string {
+	if salt := os.Getenv(EnvMaskSalt); salt != "" {
+		return salt
+	}
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
 	if err != nil {
-		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("error when dumping db: %+v\n", err) + "\n")
-		os.Exit(1)
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("cannot generate mask salt - err: %+v", err) + "\n")
+		database.Exit(1)
 	}
+	_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("using a random mask salt - set %s (or SET masksalt) for hashes and fakes stable across runs", EnvMaskSalt) + "\n")
+	return hex.EncodeToString(buf)
 }
 
-func snapshotOnly() {
-	err := database.Activity(database.ActivityNone)
+/*
+ * `SCHEDULE <DUMP|NONE> <keep dumps> <schedule spec>`, e.g. `SCHEDULE DUMP 5 @every 10m` or `SCHEDULE DUMP 5 30 2 * * *`
+ * (see database.ParseSchedule) replaces any previous schedule, `SCHEDULE OFF` stops it.
+ * the scheduled activity uses the options as set at the time of this command.
+ */
+func schedule(ctx context.Context, args []string) {
+	if len(args) == 1 && strings.EqualFold(args[0], "OFF") {
+		stopScheduler()
+		_, _ = os.Stdout.WriteString(">>> oom: " + "scheduler stopped" + "\n")
+		return
+	}
+	if len(args) < 3 {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("invalid SCHEDULE command %v - expected: SCHEDULE <DUMP|NONE> <keep dumps> <schedule> or SCHEDULE OFF", args) + "\n")
+		return
+	}
+	cmd := strings.ToUpper(args[0])
+	if cmd != database.ActivityDump && cmd != database.ActivityNone {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("invalid scheduled activity %q - expected: DUMP, NONE", args[0]) + "\n")
+		return
+	}
+	keep, err := strconv.Atoi(args[1])
+	if err != nil || keep < 0 {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("invalid number of dumps to keep %q", args[1]) + "\n")
+		return
+	}
+	sched, err := database.ParseSchedule(strings.Join(args[2:], " "))
 	if err != nil {
-		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("error when dumping db: %+v\n", err) + "\n")
-		os.Exit(1)
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("%+v", err) + "\n")
+		return
+	}
+
+	stopScheduler()
+	scheduler = database.NewScheduler(database.SchedulerConfig{Schedule: sched, Cmd: cmd, Opts: activityOpts, KeepDumps: keep}, outcomes)
+	scheduler.Start(ctx)
+	_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("scheduled %s keeping %d dumps: %s", cmd, keep, strings.Join(args[2:], " ")) + "\n")
+}
+
+/*
+ * `LOAD <dump file>` replaces the db by the one restored from the dump, `LOAD <dump file> <db file>` restores into a
+ * sqlite db file instead (created if missing) - e.g. to inspect a dump. a failed restore is reported, not fatal.
+ */
+func load(ctx context.Context, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("invalid LOAD command %v - expected: LOAD <dump file> [<db file>]", args) + "\n")
+		return
+	}
+	opts := &database.RestoreOptions{Progress: reportProgress}
+	var res *database.RestoreResult
+	var err error
+	if len(args) == 1 {
+		res, err = database.LoadDB(ctx, args[0], opts)
+	} else {
+		res, err = database.RestoreFile(ctx, args[0], args[1], opts)
+	}
+	if err != nil {
+		_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("failed to load %s - err: %+v", args[0], err) + "\n")
+		return
+	}
+	_, _ = os.Stdout.WriteString(">>> oom: " + fmt.Sprintf("loaded %s: %s", args[0], res) + "\n")
+}
+
+func stopScheduler() {
+	if scheduler != nil {
+		scheduler.Stop()
+		scheduler = nil
 	}
 }
 
-func waitInput() string {
-	var cmd string
-	_, _ = fmt.Scanln(&cmd)
-	return cmd
+// a copy of the current activityOpts - safe to be used outside the command loop
+func currentActivityOpts() *database.ActivityOptions {
+	activityOptsMu.Lock()
+	defer activityOptsMu.Unlock()
+	opts := *activityOpts
+	return &opts
+}
+
+/*
+ * stdin lines in a channel, closed at EOF - so the command loop can wait for either the next command or ctx
+ */
+func readInputs() <-chan string {
+	inputs := make(chan string)
+	go func() {
+		defer close(inputs)
+		for stdin.Scan() {
+			inputs <- stdin.Text()
+		}
+	}()
+	return inputs
+}
+
+func waitInput(ctx context.Context, inputs <-chan string) (string, []string) {
+	var line string
+	select {
+	case <-ctx.Done():
+		return "", nil
+	case line = <-inputs:
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return fields[0], fields[1:]
 }